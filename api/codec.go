@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// HeaderCodecMeta - name of stack metadata value with codec of message headers
+const HeaderCodecMeta = "header-codec"
+
+// HeaderCodec - codec of message headers which are stored in stack. Repeated values of header are kept in slice
+type HeaderCodec interface {
+	Encode(headers map[string][]string) ([]byte, error)
+	Decode(data []byte) (map[string][]string, error)
+}
+
+// JSONCodec - JSON object of strings. Repeated values are joined by comma
+type JSONCodec struct{}
+
+// Encode headers to JSON object
+func (JSONCodec) Encode(headers map[string][]string) ([]byte, error) {
+	return json.Marshal(JoinValues(headers))
+}
+
+// Decode headers from JSON object
+func (JSONCodec) Decode(data []byte) (map[string][]string, error) {
+	var v map[string]string
+	err := json.Unmarshal(data, &v)
+	return SplitValues(v), err
+}
+
+// MsgpackCodec - MessagePack map of strings. Repeated values are joined by comma
+type MsgpackCodec struct{}
+
+// Encode headers to MessagePack map
+func (MsgpackCodec) Encode(headers map[string][]string) ([]byte, error) {
+	return msgpack.Marshal(JoinValues(headers))
+}
+
+// Decode headers from MessagePack map
+func (MsgpackCodec) Decode(data []byte) (map[string][]string, error) {
+	var v map[string]string
+	err := msgpack.Unmarshal(data, &v)
+	return SplitValues(v), err
+}
+
+// MultiCodec - JSON object of string arrays: repeated values are kept
+type MultiCodec struct{}
+
+// Encode headers to JSON object of arrays
+func (MultiCodec) Encode(headers map[string][]string) ([]byte, error) { return json.Marshal(headers) }
+
+// Decode headers from JSON object of arrays
+func (MultiCodec) Decode(data []byte) (map[string][]string, error) {
+	var v map[string][]string
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// RawCodec - arbitrary bytes (as written by other file-stack users). Only raw headers are saved
+type RawCodec struct{}
+
+// Encode nothing: headers are dropped
+func (RawCodec) Encode(headers map[string][]string) ([]byte, error) { return nil, nil }
+
+// Decode nothing: data is available only as raw headers
+func (RawCodec) Decode(data []byte) (map[string][]string, error) { return nil, nil }
+
+var (
+	headerCodecsLock sync.RWMutex
+	headerCodecs     = map[string]HeaderCodec{
+		"json":    JSONCodec{},
+		"msgpack": MsgpackCodec{},
+		"multi":   MultiCodec{},
+		"raw":     RawCodec{},
+	}
+)
+
+// RegisterHeaderCodec - make codec available by name. Name is recorded in metadata of stacks, so codec must be
+// registered under the same name before stacks are opened again. Panics if name is already registered
+func RegisterHeaderCodec(name string, codec HeaderCodec) {
+	headerCodecsLock.Lock()
+	defer headerCodecsLock.Unlock()
+	if codec == nil {
+		panic("header codec " + name + " is nil")
+	}
+	if _, ok := headerCodecs[name]; ok {
+		panic("header codec " + name + " is already registered")
+	}
+	headerCodecs[name] = codec
+}
+
+// LookupHeaderCodec - registered codec by name
+func LookupHeaderCodec(name string) (HeaderCodec, bool) {
+	headerCodecsLock.RLock()
+	defer headerCodecsLock.RUnlock()
+	codec, ok := headerCodecs[name]
+	return codec, ok
+}
+
+// JoinValues - headers with repeated values joined by comma
+func JoinValues(headers map[string][]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	res := make(map[string]string, len(headers))
+	for key, values := range headers {
+		res[key] = strings.Join(values, ", ")
+	}
+	return res
+}
+
+// SplitValues - headers with single value each
+func SplitValues(headers map[string]string) map[string][]string {
+	if headers == nil {
+		return nil
+	}
+	res := make(map[string][]string, len(headers))
+	for key, value := range headers {
+		res[key] = []string{value}
+	}
+	return res
+}
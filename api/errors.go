@@ -0,0 +1,75 @@
+package api
+
+import (
+	"errors"
+	"net/rpc"
+)
+
+// Code - kind of API error
+type Code string
+
+// Error codes
+const (
+	CodeNotFound     Code = "not_found"     // Section not found
+	CodeEmpty        Code = "empty"         // Section is empty
+	CodeOutOfRange   Code = "out_of_range"  // Depth index out of range
+	CodeUnknownWatch Code = "unknown_watch" // Subscription not found
+	CodeCorrupted    Code = "corrupted"     // Message is corrupted
+	CodeUnauthorized Code = "unauthorized"  // Credentials are missing or wrong
+	CodeForbidden    Code = "forbidden"     // Access to section is denied
+	CodeHeaderCodec  Code = "header_codec"  // Header codecs of sections are different
+	CodeNotStack     Code = "not_stack"     // File of section is not a stack
+	CodeInvalid      Code = "invalid"       // Bad request
+	CodeIO           Code = "io"            // I/O failure or other server error
+)
+
+var errorCodes = map[error]Code{
+	ErrSectionNotFound: CodeNotFound,
+	ErrStackIsEmpty:    CodeEmpty,
+	ErrOutOfRange:      CodeOutOfRange,
+	ErrUnknownWatch:    CodeUnknownWatch,
+	ErrCorrupted:       CodeCorrupted,
+	ErrUnauthorized:    CodeUnauthorized,
+	ErrAccessDenied:    CodeForbidden,
+	ErrHeaderCodec:     CodeHeaderCodec,
+	ErrNotStack:        CodeNotStack,
+}
+
+// ErrorBody - JSON body of error response in HTTP API
+type ErrorBody struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrorCode - code of API error. Other errors are treated as I/O failures
+func ErrorCode(err error) Code {
+	if code, ok := errorCodes[ParseError(err)]; ok {
+		return code
+	}
+	return CodeIO
+}
+
+// FromCode - API error by code and message. Known codes are converted to common errors (ErrSectionNotFound and others)
+func FromCode(code Code, message string) error {
+	for known, knownCode := range errorCodes {
+		if knownCode == code {
+			return known
+		}
+	}
+	return errors.New(message)
+}
+
+// ParseError - convert error received over RPC to common error (ErrSectionNotFound and others) which can be compared.
+// Unknown errors are returned as is
+func ParseError(e error) error {
+	serverError, ok := e.(rpc.ServerError)
+	if !ok {
+		return e
+	}
+	for known := range errorCodes {
+		if known.Error() == string(serverError) {
+			return known
+		}
+	}
+	return e
+}
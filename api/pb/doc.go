@@ -0,0 +1,4 @@
+// Package pb contains protobuf definition of gRPC API (stackdb.proto) and generated Go stubs
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative stackdb.proto
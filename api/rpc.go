@@ -10,12 +10,20 @@ func (e err) Error() string { return string(e) }
 const (
 	ErrSectionNotFound = err("Section not found")
 	ErrStackIsEmpty    = err("Section is empty")
+	ErrOutOfRange      = err("Depth index out of range")
+	ErrUnknownWatch    = err("Subscription not found")
+	ErrCorrupted       = err("Message is corrupted")
+	ErrUnauthorized    = err("Authentication required")
+	ErrAccessDenied    = err("Access denied")
+	ErrHeaderCodec     = err("Header codecs of sections are different")
+	ErrNotStack        = err("Section file is not a stack")
 )
 
 // Message represenation in stack
 type Message struct {
-	Headers map[string]string // Headers are decoded to JSON (may be changed in future)
-	Body    []byte
+	Headers    map[string]string // Headers decoded by codec of section. Repeated values are joined by comma
+	RawHeaders []byte            `json:",omitempty"` // Headers as stored: set if section is not JSON-encoded or headers can't be decoded. Pushed as is if not nil
+	Body       []byte
 }
 
 // PushArgs - arguments for PUSH operation
@@ -24,12 +32,79 @@ type PushArgs struct {
 	Section string // Stack name
 }
 
+// PushResult - result of PUSH operation
+type PushResult struct {
+	DepthIndex int    // New stack depth - depth index of pushed message
+	Durability string // Durability guarantee of pushed message: none, always (synced) or interval (synced later)
+}
+
 // DataResult - result of PUSH and PEAK operation
 type DataResult struct {
 	Message        // Message content
 	DepthIndex int // Current stack depth (before operation) - non-atomic op.
 }
 
+// TxOp - operation of transaction: push message or pop last message
+type TxOp struct {
+	Pop     bool   // Pop last message instead of push
+	Message        // Content of pushed message
+	Section string // Stack name
+}
+
+// MoveArgs - arguments for MOVE operation
+type MoveArgs struct {
+	Section string // Source stack name
+	To      string // Destination stack name
+}
+
+// PopWaitArgs - arguments for blocking POP operation
+type PopWaitArgs struct {
+	Section string        // Stack name
+	Timeout time.Duration // Maximum time of waiting for message
+}
+
+// IndexArgs - arguments for GET operation
+type IndexArgs struct {
+	Section    string // Stack name
+	DepthIndex int    // Depth index of message (1 - first pushed message)
+}
+
+// RangeArgs - arguments for RANGE operation
+type RangeArgs struct {
+	Section string // Stack name
+	From    int    // First depth index (inclusive)
+	To      int    // Last depth index (inclusive)
+}
+
+// HistoryArgs - arguments for HISTORY operation
+type HistoryArgs struct {
+	Section   string // Stack name
+	Offset    int    // Number of skipped messages
+	Limit     int    // Maximum number of messages
+	Ascending bool   // Order from first to last message (by default from last to first)
+}
+
+// Event of section change (push or pop)
+type Event struct {
+	Type    string // push or pop
+	Section string // Stack name
+	Depth   int    // Stack depth after operation
+	Time    time.Time
+}
+
+// EventsArgs - arguments for receiving events of subscription
+type EventsArgs struct {
+	ID      uint64        // Subscription ID
+	Timeout time.Duration // Maximum time of waiting for events
+}
+
+// AuthArgs - credentials of client: token or user name and password
+type AuthArgs struct {
+	Token    string // Bearer token
+	User     string // User name (for password authentication)
+	Password string // Password of user
+}
+
 // Section (stack) basic info
 type Section struct {
 	Name       string
@@ -37,10 +112,34 @@ type Section struct {
 	LastAccess time.Time
 }
 
+// SectionMeta - detailed info of section (HTTP API)
+type SectionMeta struct {
+	Section
+	Size        int64     // Size of all messages in stack file (bytes)
+	Format      int       // Version of stack file format
+	FirstPushed time.Time // Push time of first message. Zero if stack is empty or time is unknown
+	LastPushed  time.Time // Push time of last message. Zero if stack is empty or time is unknown
+	HeaderCodec string    // Codec of message headers: json, msgpack, multi or raw
+}
+
 // Service API
 type Service interface {
 	Sections(prefix string, result *[]Section) error
+	Children(section string, result *[]string) error
 	Push(msg PushArgs, resultDepthIndex *int) error
+	PushSync(msg PushArgs, result *PushResult) error
+	PushBatch(batch []PushArgs, result *[]PushResult) error
+	Transact(ops []TxOp, result *[]DataResult) error
+	Move(args MoveArgs, result *DataResult) error
 	Peak(section string, result *DataResult) error
 	Pop(section string, result *DataResult) error
+	PopWait(args PopWaitArgs, result *DataResult) error
+	Get(args IndexArgs, result *DataResult) error
+	Range(args RangeArgs, result *[]DataResult) error
+	History(args HistoryArgs, result *[]DataResult) error
+	Watch(prefix string, subscriptionID *uint64) error
+	Events(args EventsArgs, result *[]Event) error
+	Unwatch(subscriptionID uint64, ok *bool) error
+	Compact(section string, dropped *int) error
+	Auth(args AuthArgs, ok *bool) error
 }
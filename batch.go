@@ -0,0 +1,30 @@
+package fstack
+
+// Message of batch push
+type Message struct {
+	Key    string // Stack key
+	Header []byte // Message header
+	Data   []byte // Message body
+}
+
+// PushBatch - push messages to stacks (stacks are created if not exist) atomically as one transaction (see Tx):
+// all messages are pushed or none of them. Messages of the same stack are written with one write and synced
+// once by durability mode. Returns depth index of each message in order of messages
+func (db *Database) PushBatch(messages []Message) ([]int, error) {
+	if len(messages) == 0 {
+		return []int{}, nil
+	}
+	tx := db.Begin()
+	for _, msg := range messages {
+		tx.Push(msg.Key, msg.Header, msg.Data)
+	}
+	results, err := tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	depths := make([]int, len(results))
+	for i, result := range results {
+		depths[i] = result.Depth
+	}
+	return depths, nil
+}
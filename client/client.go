@@ -0,0 +1,201 @@
+// Package client provides access to stack database server (stackdbd) over Go RPC, HTTP RPC or plain HTTP API.
+//
+// Client implements api.Service. Connections are opened on demand, kept in pool and reopened after failures.
+// Credentials (Token or BasicAuth options) are sent with each HTTP request or once per RPC connection.
+// Errors of API (api.ErrSectionNotFound, api.ErrStackIsEmpty and others) are restored from RPC messages and HTTP error codes,
+// so they can be compared.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/reddec/file-stack-db/api"
+)
+
+// ErrNotSupported - method is not available over used protocol
+var ErrNotSupported = errors.New("method is not supported by protocol")
+
+// Default number of connections in pool
+const defaultPoolSize = 4
+
+// Protocol of calling API methods
+type transport interface {
+	call(ctx context.Context, method string, args interface{}, reply interface{}) error
+	close() error
+}
+
+// Client of stack database. Safe for concurrent use
+type Client struct {
+	transport transport
+	ctx       context.Context
+	timeout   time.Duration
+}
+
+type options struct {
+	poolSize int
+	timeout  time.Duration
+	creds    api.AuthArgs
+	tls      *tls.Config
+}
+
+// Option of client
+type Option func(opts *options)
+
+// PoolSize - maximum number of opened connections (and concurrent calls). Default is 4
+func PoolSize(size int) Option {
+	return func(opts *options) { opts.poolSize = size }
+}
+
+// Timeout - default timeout of each call. It's not applied if context of call already has deadline
+func Timeout(timeout time.Duration) Option {
+	return func(opts *options) { opts.timeout = timeout }
+}
+
+// Token - authenticate by bearer token
+func Token(token string) Option {
+	return func(opts *options) { opts.creds = api.AuthArgs{Token: token} }
+}
+
+// BasicAuth - authenticate by user name and password
+func BasicAuth(user, password string) Option {
+	return func(opts *options) { opts.creds = api.AuthArgs{User: user, Password: password} }
+}
+
+// TLS - connect by TLS with config (CA of server, client certificate). HTTP API client uses TLS for https URLs
+func TLS(config *tls.Config) Option {
+	return func(opts *options) { opts.tls = config }
+}
+
+// Value of Authorization header or empty string without credentials
+func (opts options) authorization() string {
+	if opts.creds.Token != "" {
+		return "Bearer " + opts.creds.Token
+	}
+	if opts.creds.User != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(opts.creds.User+":"+opts.creds.Password))
+	}
+	return ""
+}
+
+func newOptions(opts []Option) options {
+	res := options{poolSize: defaultPoolSize}
+	for _, opt := range opts {
+		opt(&res)
+	}
+	if res.poolSize < 1 {
+		res.poolSize = 1
+	}
+	return res
+}
+
+func newClient(transport transport, opts options) *Client {
+	return &Client{transport: transport, ctx: context.Background(), timeout: opts.timeout}
+}
+
+// WithContext - copy of client which calls are bound to context. Connections are shared with original client
+func (c *Client) WithContext(ctx context.Context) *Client {
+	cp := *c
+	cp.ctx = ctx
+	return &cp
+}
+
+// Close all connections. Client and all its copies can't be used after close
+func (c *Client) Close() error {
+	return c.transport.close()
+}
+
+func (c *Client) call(method string, args interface{}, reply interface{}) error {
+	ctx := c.ctx
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return typedError(c.transport.call(ctx, method, args, reply))
+}
+
+// Convert error received from server to common error of API
+func typedError(err error) error {
+	if v, ok := err.(*httpError); ok {
+		return api.FromCode(v.body.Code, v.body.Message)
+	}
+	return api.ParseError(err)
+}
+
+func (c *Client) Sections(prefix string, result *[]api.Section) error {
+	return c.call("Sections", prefix, result)
+}
+
+func (c *Client) Children(section string, result *[]string) error {
+	return c.call("Children", section, result)
+}
+
+func (c *Client) Push(msg api.PushArgs, resultDepthIndex *int) error {
+	return c.call("Push", msg, resultDepthIndex)
+}
+
+func (c *Client) PushSync(msg api.PushArgs, result *api.PushResult) error {
+	return c.call("PushSync", msg, result)
+}
+
+func (c *Client) PushBatch(batch []api.PushArgs, result *[]api.PushResult) error {
+	return c.call("PushBatch", batch, result)
+}
+
+func (c *Client) Transact(ops []api.TxOp, result *[]api.DataResult) error {
+	return c.call("Transact", ops, result)
+}
+
+func (c *Client) Move(args api.MoveArgs, result *api.DataResult) error {
+	return c.call("Move", args, result)
+}
+
+func (c *Client) Peak(section string, result *api.DataResult) error {
+	return c.call("Peak", section, result)
+}
+
+func (c *Client) Pop(section string, result *api.DataResult) error {
+	return c.call("Pop", section, result)
+}
+
+func (c *Client) PopWait(args api.PopWaitArgs, result *api.DataResult) error {
+	return c.call("PopWait", args, result)
+}
+
+func (c *Client) Get(args api.IndexArgs, result *api.DataResult) error {
+	return c.call("Get", args, result)
+}
+
+func (c *Client) Range(args api.RangeArgs, result *[]api.DataResult) error {
+	return c.call("Range", args, result)
+}
+
+func (c *Client) History(args api.HistoryArgs, result *[]api.DataResult) error {
+	return c.call("History", args, result)
+}
+
+func (c *Client) Watch(prefix string, subscriptionID *uint64) error {
+	return c.call("Watch", prefix, subscriptionID)
+}
+
+func (c *Client) Events(args api.EventsArgs, result *[]api.Event) error {
+	return c.call("Events", args, result)
+}
+
+func (c *Client) Unwatch(subscriptionID uint64, ok *bool) error {
+	return c.call("Unwatch", subscriptionID, ok)
+}
+
+func (c *Client) Compact(section string, dropped *int) error {
+	return c.call("Compact", section, dropped)
+}
+
+// Auth - authenticate by credentials. RPC clients authenticate each connection by credentials from options,
+// so this call affects only one connection of pool
+func (c *Client) Auth(args api.AuthArgs, ok *bool) error {
+	return c.call("Auth", args, ok)
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/reddec/file-stack-db/api"
+)
+
+// Prefix of message headers in HTTP API
+const headerPrefix = "S-"
+
+// Header with base64 of raw message headers in HTTP API
+const rawHeadersHeader = "Raw-Headers"
+
+// Error response of HTTP API
+type httpError struct {
+	status int
+	body   api.ErrorBody
+}
+
+func (e *httpError) Error() string {
+	if e.body.Message == "" {
+		return http.StatusText(e.status)
+	}
+	return e.body.Message
+}
+
+// Plain HTTP API. Methods without HTTP endpoints (transactions, ranges, RPC subscriptions)
+// return ErrNotSupported
+type httpTransport struct {
+	base          string
+	client        *http.Client
+	authorization string
+}
+
+// NewHTTP - client of HTTP API (stackdbd -http). Base URL is address of server like http://127.0.0.1:9001
+func NewHTTP(baseURL string, opts ...Option) *Client {
+	o := newOptions(opts)
+	transport := &httpTransport{
+		base: strings.TrimRight(baseURL, "/"),
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: o.poolSize,
+			TLSClientConfig:     o.tls,
+		}},
+		authorization: o.authorization(),
+	}
+	return newClient(transport, o)
+}
+
+func (t *httpTransport) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	switch method {
+	case "Sections":
+		res, err := t.do(ctx, "GET", "", url.Values{"prefix": {args.(string)}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(res.body, reply)
+	case "Push", "PushSync":
+		msg := args.(api.PushArgs)
+		headers := http.Header{}
+		for key, value := range msg.Headers {
+			headers.Set(headerPrefix+key, value)
+		}
+		if msg.RawHeaders != nil {
+			headers.Set(rawHeadersHeader, base64.StdEncoding.EncodeToString(msg.RawHeaders))
+		}
+		res, err := t.do(ctx, "POST", msg.Section, nil, headers, msg.Body)
+		if err != nil {
+			return err
+		}
+		depth, err := strconv.Atoi(strings.TrimSpace(string(res.body)))
+		if result, ok := reply.(*api.PushResult); ok {
+			result.DepthIndex = depth
+			result.Durability = res.header.Get("Durability")
+		} else {
+			*reply.(*int) = depth
+		}
+		return err
+	case "PushBatch":
+		data, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		res, err := t.do(ctx, "POST", "_batch", nil, nil, data)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(res.body, reply)
+	case "Move":
+		move := args.(api.MoveArgs)
+		res, err := t.do(ctx, "POST", "_move/"+move.Section, url.Values{"to": {move.To}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		return res.message(reply.(*api.DataResult), "Id", 0)
+	case "Peak":
+		res, err := t.do(ctx, "GET", args.(string), nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		return res.message(reply.(*api.DataResult), "Count", 0)
+	case "Pop", "PopWait":
+		section, query := "", url.Values{}
+		if method == "Pop" {
+			section = args.(string)
+		} else {
+			section = args.(api.PopWaitArgs).Section
+			query.Set("wait", args.(api.PopWaitArgs).Timeout.String())
+		}
+		res, err := t.do(ctx, "DELETE", section, query, nil, nil)
+		if err != nil {
+			return err
+		}
+		// Count is depth after pop
+		return res.message(reply.(*api.DataResult), "Count", 1)
+	case "Get":
+		index := args.(api.IndexArgs)
+		res, err := t.do(ctx, "GET", "_at/"+strconv.Itoa(index.DepthIndex)+"/"+index.Section, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		return res.message(reply.(*api.DataResult), "Id", 0)
+	case "History":
+		history := args.(api.HistoryArgs)
+		query := url.Values{"offset": {strconv.Itoa(history.Offset)}, "limit": {strconv.Itoa(history.Limit)}}
+		if history.Ascending {
+			query.Set("order", "asc")
+		}
+		res, err := t.do(ctx, "GET", "_history/"+history.Section, query, nil, nil)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(res.body, reply)
+	case "Compact":
+		res, err := t.do(ctx, "POST", "_compact/"+args.(string), nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(res.body, reply)
+	}
+	return ErrNotSupported
+}
+
+type httpResponse struct {
+	header http.Header
+	body   []byte
+}
+
+// Fill message by headers (with prefix), raw headers and body of response. Depth index is taken from header
+func (res *httpResponse) message(result *api.DataResult, depthHeader string, depthShift int) error {
+	result.Headers = map[string]string{}
+	for key, values := range res.header {
+		if strings.HasPrefix(key, headerPrefix) {
+			result.Headers[key[len(headerPrefix):]] = strings.Join(values, ", ")
+		}
+	}
+	result.RawHeaders = nil
+	if raw := res.header.Get(rawHeadersHeader); raw != "" {
+		var err error
+		if result.RawHeaders, err = base64.StdEncoding.DecodeString(raw); err != nil {
+			return err
+		}
+	}
+	result.Body = res.body
+	depth, err := strconv.Atoi(res.header.Get(depthHeader))
+	result.DepthIndex = depth + depthShift
+	return err
+}
+
+func (t *httpTransport) do(ctx context.Context, method, path string, query url.Values, headers http.Header, body []byte) (*httpResponse, error) {
+	u := t.base + (&url.URL{Path: "/" + path}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+	if t.authorization != "" {
+		req.Header.Set("Authorization", t.authorization)
+	}
+	res, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		httpErr := &httpError{status: res.StatusCode}
+		if json.Unmarshal(data, &httpErr.body) != nil {
+			httpErr.body = api.ErrorBody{Code: api.CodeIO, Message: strings.TrimSpace(string(data))}
+		}
+		return nil, httpErr
+	}
+	return &httpResponse{header: res.Header, body: data}, nil
+}
+
+func (t *httpTransport) close() error {
+	t.client.Transport.(*http.Transport).CloseIdleConnections()
+	return nil
+}
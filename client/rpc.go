@@ -0,0 +1,191 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/reddec/file-stack-db/api"
+)
+
+// Go RPC (gob) over TCP or HTTP with pool of connections
+type rpcTransport struct {
+	address string
+	http    bool
+	slots   chan struct{}    // limit of opened connections
+	idle    chan *rpc.Client // opened connections without calls
+	done    chan struct{}
+	closed  sync.Once
+	creds   api.AuthArgs
+	tls     *tls.Config
+}
+
+// NewRPC - client of Go RPC endpoint (stackdbd -rpc)
+func NewRPC(address string, opts ...Option) *Client {
+	o := newOptions(opts)
+	return newClient(newRPCTransport(address, false, o), o)
+}
+
+// NewHTTPRPC - client of Go RPC over HTTP endpoint with default path (stackdbd -http-rpc)
+func NewHTTPRPC(address string, opts ...Option) *Client {
+	o := newOptions(opts)
+	return newClient(newRPCTransport(address, true, o), o)
+}
+
+func newRPCTransport(address string, http bool, opts options) *rpcTransport {
+	return &rpcTransport{
+		address: address,
+		http:    http,
+		slots:   make(chan struct{}, opts.poolSize),
+		idle:    make(chan *rpc.Client, opts.poolSize),
+		done:    make(chan struct{}),
+		creds:   opts.creds,
+		tls:     opts.tls,
+	}
+}
+
+var errClosed = errors.New("client is closed")
+
+func (t *rpcTransport) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.done:
+		return errClosed
+	}
+	defer func() { <-t.slots }()
+	for {
+		conn, reused, err := t.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		err = t.invoke(ctx, conn, "db."+method, args, reply)
+		if _, ok := err.(rpc.ServerError); err == nil || ok {
+			t.release(conn)
+			return err
+		}
+		conn.Close()
+		// Broken idle connection: request was not sent, so call may be repeated by new connection
+		if err != rpc.ErrShutdown || !reused {
+			return err
+		}
+	}
+}
+
+// Call method and wait for result or end of context. Connection can't be used after context end
+func (t *rpcTransport) invoke(ctx context.Context, conn *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := conn.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Idle connection or new one
+func (t *rpcTransport) acquire(ctx context.Context) (*rpc.Client, bool, error) {
+	select {
+	case conn := <-t.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err := t.dial(ctx)
+	return conn, false, err
+}
+
+func (t *rpcTransport) release(conn *rpc.Client) {
+	select {
+	case <-t.done:
+		conn.Close()
+		return
+	default:
+	}
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (t *rpcTransport) dial(ctx context.Context) (*rpc.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, err
+	}
+	if t.tls != nil {
+		config := t.tls.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(t.address)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if !t.http {
+		return t.login(ctx, rpc.NewClient(conn))
+	}
+	// Same handshake as rpc.DialHTTP but bound to context
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{Method: "CONNECT", URL: &url.URL{Path: rpc.DefaultRPCPath}, Header: http.Header{}, Host: t.address}
+	if t.creds.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.creds.Token)
+	} else if t.creds.User != "" {
+		req.SetBasicAuth(t.creds.User, t.creds.Password)
+	}
+	err = req.Write(conn)
+	var res *http.Response
+	if err == nil {
+		res, err = http.ReadResponse(bufio.NewReader(conn), req)
+	}
+	if err == nil && res.StatusCode == http.StatusUnauthorized {
+		err = api.ErrUnauthorized
+	} else if err == nil && res.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + res.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+// Authenticate new connection by credentials (if set)
+func (t *rpcTransport) login(ctx context.Context, conn *rpc.Client) (*rpc.Client, error) {
+	if t.creds == (api.AuthArgs{}) {
+		return conn, nil
+	}
+	var ok bool
+	if err := t.invoke(ctx, conn, "db.Auth", t.creds, &ok); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *rpcTransport) close() error {
+	t.closed.Do(func() { close(t.done) })
+	for {
+		select {
+		case conn := <-t.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -1,65 +1,134 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/rpc"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/reddec/file-stack-db/api"
+	"github.com/reddec/file-stack-db/client"
 )
 
+// Command line arguments without flags. First item is program name
+var cmdArgs []string
+
 func main() {
-	if len(os.Args) < 3 {
+	useTLS := flag.Bool("tls", false, "Connect to Go RPC endpoint by TLS (https URLs always use TLS)")
+	tlsCA := flag.String("tls-ca", "", "CA certificates (PEM) of server instead of system ones. Enables TLS")
+	tlsCert := flag.String("tls-cert", "", "Client certificate (PEM). Enables TLS")
+	tlsKey := flag.String("tls-key", "", "Private key (PEM) of client certificate")
+	flag.Usage = usage
+	flag.Parse()
+	cmdArgs = append([]string{os.Args[0]}, flag.Args()...)
+	if len(cmdArgs) < 3 {
 		usage()
 	}
-	addr := os.Args[2]
-	http := false
-	var err error
-	var client *rpc.Client
-	if http {
-		client, err = rpc.DialHTTP("tcp", addr)
-	} else {
-		client, err = rpc.Dial("tcp", addr)
+	addr := cmdArgs[2]
+	var opts []client.Option
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		config, err := tlsConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, client.TLS(config))
 	}
-	if err != nil {
-		log.Fatal(err)
+	if token := os.Getenv("STACKDB_TOKEN"); token != "" {
+		opts = append(opts, client.Token(token))
+	} else if user := os.Getenv("STACKDB_USER"); user != "" {
+		opts = append(opts, client.BasicAuth(user, os.Getenv("STACKDB_PASSWORD")))
+	}
+	var c *client.Client
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		c = client.NewHTTP(addr, opts...)
+	} else {
+		c = client.NewRPC(addr, opts...)
 	}
-	defer client.Close()
-	switch os.Args[1] {
+	defer c.Close()
+	switch cmdArgs[1] {
 	case "push":
-		push(client)
+		push(c)
 	case "pop":
-		pop(client)
+		pop(c)
+	case "popwait":
+		popWait(c)
+	case "move":
+		move(c)
 	case "peak":
-		peak(client)
+		peak(c)
+	case "get":
+		get(c)
+	case "history":
+		history(c)
 	case "sections":
-		sections(client)
+		sections(c)
+	case "compact":
+		compact(c)
 	default:
 		usage()
 	}
 }
 
+// TLS config with optional CA of server and client certificate
+func tlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates in " + caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
 func usage() {
 	fmt.Println(`
 Command line access to file stack database
+
+  stackdbcli [flags] <command> <address> [arguments]
+
+Address is host:port of Go RPC endpoint or URL (http://host:port) of HTTP API
+Credentials are taken from STACKDB_TOKEN or STACKDB_USER and STACKDB_PASSWORD environment variables
 Commands:
 
   push     <address> <section> [headers=value ...] - push data to file-stack-db
   peak     <address> <section>                     - get last data
   pop      <address> <section>                     - get and remove last data
-  sections <address> <prefix >                     - get section info filtered by prefix`)
+  popwait  <address> <section> <timeout>           - get and remove last data, wait for data if empty
+  move     <address> <section> <to>                - move last data to another section atomically
+  get      <address> <section> <index>             - get data by depth index (1 - first pushed)
+  history  <address> <section> [offset [limit [asc]]] - list history from last (or first) message
+  sections <address> <prefix >                     - get section info filtered by prefix
+  compact  <address> <section>                     - compact section by retention policy
+
+Flags:`)
+	flag.PrintDefaults()
 	os.Exit(1)
 }
 
-func push(client *rpc.Client) {
+func push(c *client.Client) {
 	var args api.PushArgs
-	args.Section = os.Args[3]
+	args.Section = cmdArgs[3]
 	args.Headers = make(map[string]string)
-	for _, arg := range os.Args[4:] {
+	for _, arg := range cmdArgs[4:] {
 		parts := strings.SplitN(arg, "=", 2)
 		if len(parts) != 2 {
 			continue
@@ -71,32 +140,100 @@ func push(client *rpc.Client) {
 		log.Fatal(err)
 	}
 	args.Body = data
-	var id int
-	err = client.Call("db.Push", args, &id)
+	var result api.PushResult
+	err = c.PushSync(args, &result)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(result.DepthIndex)
+	fmt.Fprintln(os.Stderr, "durability:", result.Durability)
+}
+
+func move(c *client.Client) {
+	var data api.DataResult
+	err := c.Move(api.MoveArgs{Section: cmdArgs[3], To: cmdArgs[4]}, &data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printSingleMessage(data)
+}
+
+func pop(c *client.Client) {
+	var data api.DataResult
+	err := c.Pop(cmdArgs[3], &data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printSingleMessage(data)
+}
+
+func popWait(c *client.Client) {
+	if len(cmdArgs) < 5 {
+		usage()
+	}
+	timeout, err := time.ParseDuration(cmdArgs[4])
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(id)
+	var data api.DataResult
+	err = c.PopWait(api.PopWaitArgs{Section: cmdArgs[3], Timeout: timeout}, &data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printSingleMessage(data)
 }
 
-func pop(client *rpc.Client) {
+func peak(c *client.Client) {
 	var data api.DataResult
-	err := client.Call("db.Pop", os.Args[3], &data)
+	err := c.Peak(cmdArgs[3], &data)
 	if err != nil {
 		log.Fatal(err)
 	}
 	printSingleMessage(data)
 }
 
-func peak(client *rpc.Client) {
+func get(c *client.Client) {
+	var args api.IndexArgs
+	args.Section = cmdArgs[3]
+	if len(cmdArgs) < 5 {
+		usage()
+	}
+	index, err := strconv.Atoi(cmdArgs[4])
+	if err != nil {
+		log.Fatal(err)
+	}
+	args.DepthIndex = index
 	var data api.DataResult
-	err := client.Call("db.Peak", os.Args[3], &data)
+	err = c.Get(args, &data)
 	if err != nil {
 		log.Fatal(err)
 	}
 	printSingleMessage(data)
 }
 
+func history(c *client.Client) {
+	args := api.HistoryArgs{Section: cmdArgs[3], Limit: 50}
+	var err error
+	if len(cmdArgs) > 4 {
+		args.Offset, err = strconv.Atoi(cmdArgs[4])
+	}
+	if len(cmdArgs) > 5 && err == nil {
+		args.Limit, err = strconv.Atoi(cmdArgs[5])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	args.Ascending = len(cmdArgs) > 6 && cmdArgs[6] == "asc"
+	var messages []api.DataResult
+	err = c.History(args, &messages)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, message := range messages {
+		fmt.Println(message.DepthIndex, string(message.Body))
+	}
+}
+
 func printSingleMessage(data api.DataResult) {
 	for k, v := range data.Headers {
 		fmt.Fprintf(os.Stderr, "%s=%s\n", k, v)
@@ -104,15 +241,15 @@ func printSingleMessage(data api.DataResult) {
 	os.Stdout.Write(data.Body)
 }
 
-func sections(client *rpc.Client) {
+func sections(c *client.Client) {
 	var secs []api.Section
 	var prefix string
-	if len(os.Args) < 4 {
+	if len(cmdArgs) < 4 {
 		prefix = ""
 	} else {
-		prefix = os.Args[3]
+		prefix = cmdArgs[3]
 	}
-	err := client.Call("db.Sections", prefix, &secs)
+	err := c.Sections(prefix, &secs)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -121,3 +258,12 @@ func sections(client *rpc.Client) {
 		fmt.Println(id, sec.Name, sec.Depth, sec.LastAccess.Format(time.RFC3339Nano))
 	}
 }
+
+func compact(c *client.Client) {
+	var dropped int
+	err := c.Compact(cmdArgs[3], &dropped)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(dropped)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/filestack"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "migrate":
+		migrate(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Println(`
+Maintenance of file stack database files. Database must be stopped
+Commands:
+
+  migrate [-root <dir>] [-dry-run] [file ...] - upgrade stack files to current format in place`)
+	os.Exit(1)
+}
+
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	root := flags.String("root", "./db", "Root dir for stacked database (used if no files specified)")
+	dryRun := flags.Bool("dry-run", false, "Only show files which have to be migrated")
+	flags.Parse(args)
+	files := flags.Args()
+	if len(files) == 0 {
+		err := filepath.Walk(*root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Index and temporary files have # in name. Stack files of previous versions are named by key
+			if !info.IsDir() && (info.Name() == fstack.StackFile || !strings.Contains(info.Name(), "#")) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var migrated, failed int
+	for _, file := range files {
+		format, headerless, err := filestack.CheckFile(file)
+		if err != nil {
+			log.Println("Skip", file, "-", err)
+			continue
+		}
+		if !headerless && format == filestack.CurrentFormat {
+			continue
+		}
+		if *dryRun {
+			log.Println("Stack", file, "has format", format, "headerless:", headerless)
+			migrated++
+			continue
+		}
+		if _, err = filestack.Migrate(file); err != nil {
+			log.Println("Failed migrate", file, "-", err)
+			failed++
+			continue
+		}
+		log.Println("Stack", file, "migrated from format", format, "headerless:", headerless)
+		migrated++
+	}
+	log.Println("Migrated:", migrated, "failed:", failed)
+	if failed > 0 {
+		os.Exit(2)
+	}
+}
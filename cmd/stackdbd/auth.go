@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Rights of access to sections
+type right int
+
+const (
+	rightRead right = 1 << iota // Peak, get, range, history and events
+	rightPush                   // Push messages
+	rightPop                    // Pop, move from section and compaction
+
+	rightAll = rightRead | rightPush | rightPop
+)
+
+var rightNames = map[string]right{"read": rightRead, "push": rightPush, "pop": rightPop, "all": rightAll}
+
+// Rule of ACL: rights of user (* - any user) to section and its sub-sections (empty prefix - all sections)
+type aclRule struct {
+	user   string
+	prefix string
+	rights right
+}
+
+// Authentication and authorization settings. Nil config means open access
+type authConfig struct {
+	tokens    map[string]string // token -> user
+	passwords map[string]string // user -> hash from htpasswd file
+	certs     bool              // identify users by common name of verified client certificate
+	acl       []aclRule         // nil - authenticated users have all rights
+}
+
+var auth *authConfig
+
+// Load authentication settings from files. Empty file names are skipped. Nil config is returned if nothing is set
+func newAuthConfig(tokensFile, htpasswdFile string, certs bool, aclFile string) (*authConfig, error) {
+	if tokensFile == "" && htpasswdFile == "" && !certs && aclFile == "" {
+		return nil, nil
+	}
+	config := &authConfig{certs: certs}
+	var err error
+	if tokensFile != "" {
+		if config.tokens, err = loadTokens(tokensFile); err != nil {
+			return nil, err
+		}
+	}
+	if htpasswdFile != "" {
+		if config.passwords, err = loadHtpasswd(htpasswdFile); err != nil {
+			return nil, err
+		}
+	}
+	if aclFile != "" {
+		if config.acl, err = loadACL(aclFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Read non-empty lines without comments (#) split by separator
+func readFields(file string, split func(line string) []string, handle func(fields []string) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = handle(split(line)); err != nil {
+			return fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func splitColon(line string) []string { return strings.SplitN(line, ":", 2) }
+
+// Tokens file: user:token per line
+func loadTokens(file string) (map[string]string, error) {
+	tokens := map[string]string{}
+	err := readFields(file, splitColon, func(fields []string) error {
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return errors.New("expected user:token")
+		}
+		tokens[fields[1]] = fields[0]
+		return nil
+	})
+	return tokens, err
+}
+
+// Htpasswd file: user:hash per line. Only bcrypt (htpasswd -B) and SHA1 (htpasswd -s) hashes are supported
+func loadHtpasswd(file string) (map[string]string, error) {
+	passwords := map[string]string{}
+	err := readFields(file, splitColon, func(fields []string) error {
+		if len(fields) != 2 || fields[0] == "" {
+			return errors.New("expected user:hash")
+		}
+		if !strings.HasPrefix(fields[1], "$2") && !strings.HasPrefix(fields[1], "{SHA}") {
+			return errors.New("unsupported hash of user " + fields[0] + ", use bcrypt (htpasswd -B)")
+		}
+		passwords[fields[0]] = fields[1]
+		return nil
+	})
+	return passwords, err
+}
+
+// ACL file: user, section prefix and comma-separated rights (read, push, pop, all) per line.
+// User * means any user, prefix * means all sections
+func loadACL(file string) ([]aclRule, error) {
+	acl := []aclRule{}
+	err := readFields(file, strings.Fields, func(fields []string) error {
+		if len(fields) != 3 {
+			return errors.New("expected user, section prefix and rights")
+		}
+		rule := aclRule{user: fields[0], prefix: fstack.CleanKey(fields[1])}
+		if fields[1] == "*" {
+			rule.prefix = ""
+		}
+		for _, name := range strings.Split(fields[2], ",") {
+			r, ok := rightNames[name]
+			if !ok {
+				return errors.New("unknown right " + name)
+			}
+			rule.rights |= r
+		}
+		acl = append(acl, rule)
+		return nil
+	})
+	return acl, err
+}
+
+// Authentication is required if any authentication method is set
+func (a *authConfig) required() bool {
+	return a != nil && (a.tokens != nil || a.passwords != nil || a.certs)
+}
+
+// Check credentials and get user name
+func (a *authConfig) login(creds api.AuthArgs) (string, error) {
+	if a == nil {
+		return creds.User, nil
+	}
+	if creds.Token != "" {
+		user := ""
+		for token, owner := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(creds.Token)) == 1 {
+				user = owner
+			}
+		}
+		if user == "" {
+			return "", api.ErrUnauthorized
+		}
+		return user, nil
+	}
+	hash, ok := a.passwords[creds.User]
+	if !ok || !checkPassword(hash, creds.Password) {
+		return "", api.ErrUnauthorized
+	}
+	return creds.User, nil
+}
+
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// User by common name of verified client certificate
+func (a *authConfig) certUser(state *tls.ConnectionState) (string, bool) {
+	if a == nil || !a.certs || state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
+
+// Check that user has right to section. Rights of all matched rules are combined
+func (a *authConfig) allowed(user, section string, r right) bool {
+	if a == nil || a.acl == nil {
+		return true
+	}
+	section = fstack.CleanKey(section)
+	var granted right
+	for _, rule := range a.acl {
+		if rule.user != "*" && rule.user != user {
+			continue
+		}
+		if rule.prefix == "" || section == rule.prefix || strings.HasPrefix(section, rule.prefix+fstack.SectionSeparator) {
+			granted |= rule.rights
+		}
+	}
+	return granted&r == r
+}
+
+// Challenge of HTTP 401 response
+func (a *authConfig) challenge() string {
+	if a != nil && a.passwords != nil {
+		return `Basic realm="stackdb"`
+	}
+	return `Bearer realm="stackdb"`
+}
+
+// Client identity of connection or HTTP request. Nil session is anonymous
+type session struct {
+	lock          sync.RWMutex
+	user          string
+	authenticated bool
+}
+
+// Parse Authorization header: Bearer token or Basic credentials
+func parseAuthorization(header string) (api.AuthArgs, bool) {
+	var creds api.AuthArgs
+	scheme, value := header, ""
+	if i := strings.IndexByte(header, ' '); i > 0 {
+		scheme, value = header[:i], strings.TrimSpace(header[i+1:])
+	}
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && value != "":
+		creds.Token = value
+		return creds, true
+	case strings.EqualFold(scheme, "Basic"):
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return creds, false
+		}
+		pair := strings.SplitN(string(data), ":", 2)
+		if len(pair) != 2 {
+			return creds, false
+		}
+		creds.User, creds.Password = pair[0], pair[1]
+		return creds, true
+	}
+	return creds, false
+}
+
+// New session by Authorization header (may be empty) and TLS state (may be nil).
+// Wrong credentials are rejected, missing credentials are checked on access to sections
+func newSession(authorization string, state *tls.ConnectionState) (*session, error) {
+	s := &session{}
+	if auth == nil {
+		return s, nil
+	}
+	if authorization != "" {
+		creds, ok := parseAuthorization(authorization)
+		if !ok {
+			return nil, api.ErrUnauthorized
+		}
+		return s, s.login(creds)
+	}
+	s.user, s.authenticated = auth.certUser(state)
+	return s, nil
+}
+
+// New session of connection. TLS handshake is made to get client certificate
+func connSession(conn net.Conn) (*session, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		return newSession("", &state)
+	}
+	return newSession("", nil)
+}
+
+// Authenticate session by credentials. Session keeps previous user on failure
+func (s *session) login(creds api.AuthArgs) error {
+	user, err := auth.login(creds)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.user, s.authenticated = user, true
+	return nil
+}
+
+// Name of user and flag of authentication
+func (s *session) identity() (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.user, s.authenticated
+}
+
+// Check right of session to section: ErrUnauthorized if credentials are required, ErrAccessDenied if ACL denies access
+func (s *session) check(section string, r right) error {
+	if auth == nil {
+		return nil
+	}
+	user, ok := s.identity()
+	if auth.required() && !ok {
+		return api.ErrUnauthorized
+	}
+	if !auth.allowed(user, section, r) {
+		return api.ErrAccessDenied
+	}
+	return nil
+}
+
+// HTTP status of authorization error
+func authStatus(err error) int {
+	if err == api.ErrUnauthorized {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+type sessionKey struct{}
+
+func withSession(ctx context.Context, s *session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// Session saved in context or nil
+func contextSession(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+// Authenticate HTTP request by Authorization header or client certificate. Session is saved in request context
+func authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := newSession(r.Header.Get("Authorization"), r.TLS)
+		if err != nil {
+			writeError(w, err, http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(withSession(r.Context(), s)))
+	})
+}
+
+// Check right of request session to section from path (or prefix from query for events)
+func protect(r right, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		section, ok := mux.Vars(req)["key"]
+		if !ok {
+			section = req.URL.Query().Get("prefix")
+		}
+		if err := contextSession(req.Context()).check(section, r); err != nil {
+			writeError(w, err, authStatus(err))
+			return
+		}
+		handler(w, req)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+	"github.com/reddec/file-stack-db/client"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Self-signed CA for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stackdb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue certificate for server (127.0.0.1) and clients with common name
+func (ca *testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writeTestFile(t *testing.T, name, content string) string {
+	if err := os.MkdirAll("test-data/auth", 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join("test-data/auth", name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestAuth(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/authdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	defer os.RemoveAll("test-data/auth")
+
+	bobHash, err := bcrypt.GenerateFromPassword([]byte("bob-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daveHash := sha1.Sum([]byte("dave-pass"))
+	tokens := writeTestFile(t, "tokens", "# user:token\nalice:alice-token\n")
+	htpasswd := writeTestFile(t, "htpasswd", "bob:"+string(bobHash)+"\ndave:{SHA}"+base64.StdEncoding.EncodeToString(daveHash[:])+"\n")
+	acl := writeTestFile(t, "acl", `
+alice orders    read,push
+bob   orders    all
+*     public    read
+carol *         read
+`)
+	auth, err = newAuthConfig(tokens, htpasswd, true, acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auth = nil }()
+	if _, err = db.Push("public", nil, []byte("news")); err != nil {
+		t.Fatal(err)
+	}
+
+	// HTTP API
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	request := func(method, path, authorization string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := request("GET", "/public", ""); res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") == "" {
+		t.Fatal("Anonymous request is not rejected", res.Status)
+	}
+	if res := request("GET", "/public", "Bearer wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("Wrong token is not rejected", res.Status)
+	}
+	if res := request("POST", "/orders", "Bearer alice-token"); res.StatusCode != http.StatusOK {
+		t.Fatal("Push is not allowed", res.Status)
+	}
+	if res := request("DELETE", "/orders", "Bearer alice-token"); res.StatusCode != http.StatusForbidden {
+		t.Fatal("Pop is not denied", res.Status)
+	}
+	if res := request("POST", "/orders-archive", "Bearer alice-token"); res.StatusCode != http.StatusForbidden {
+		t.Fatal("Prefix is not matched by sub-sections", res.Status)
+	}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("dave:dave-pass"))
+	if res := request("GET", "/public", basic); res.StatusCode != http.StatusOK {
+		t.Fatal("Read by SHA1 password is not allowed", res.Status)
+	}
+	if res := request("POST", "/_batch", basic); res.StatusCode != http.StatusBadRequest {
+		t.Fatal("Bad batch is not rejected", res.Status)
+	}
+
+	// Go RPC
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveRPC(l)
+	var data api.DataResult
+	anonymous := client.NewRPC(l.Addr().String())
+	defer anonymous.Close()
+	if err = anonymous.Peak("public", &data); err != api.ErrUnauthorized {
+		t.Fatal("Expected unauthorized error, got", err)
+	}
+	wrong := client.NewRPC(l.Addr().String(), client.Token("wrong"))
+	defer wrong.Close()
+	if err = wrong.Peak("public", &data); err != api.ErrUnauthorized {
+		t.Fatal("Expected unauthorized error, got", err)
+	}
+	alice := client.NewRPC(l.Addr().String(), client.Token("alice-token"))
+	defer alice.Close()
+	if err = alice.Peak("orders", &data); err != nil || string(data.Body) != "data" {
+		t.Fatal("Peak is not allowed", data, err)
+	}
+	if err = alice.Pop("orders", &data); err != api.ErrAccessDenied {
+		t.Fatal("Expected access denied error, got", err)
+	}
+	if err = alice.Move(api.MoveArgs{Section: "public", To: "orders/2"}, &data); err != api.ErrAccessDenied {
+		t.Fatal("Move from read-only section is not denied", err)
+	}
+	var sections []api.Section
+	if err = alice.Sections("", &sections); err != nil || len(sections) != 2 {
+		t.Fatal("Sections are not filtered by rights", sections, err)
+	}
+	var subscription uint64
+	if err = alice.Watch("orders", &subscription); err != nil {
+		t.Fatal(err)
+	}
+
+	// Go RPC over HTTP
+	httpRPC := httptest.NewServer(rpcHTTPHandler())
+	defer httpRPC.Close()
+	bob := client.NewHTTPRPC(httpRPC.Listener.Addr().String(), client.BasicAuth("bob", "bob-pass"))
+	defer bob.Close()
+	if err = bob.Pop("orders", &data); err != nil {
+		t.Fatal("Pop is not allowed", err)
+	}
+	var found bool
+	if err = bob.Unwatch(subscription, &found); err != nil || found {
+		t.Fatal("Subscription of other user is removed", err)
+	}
+	wrongBob := client.NewHTTPRPC(httpRPC.Listener.Addr().String(), client.BasicAuth("bob", "wrong"))
+	defer wrongBob.Close()
+	if err = wrongBob.Peak("orders", &data); err != api.ErrUnauthorized {
+		t.Fatal("Expected unauthorized error, got", err)
+	}
+
+	// Redis protocol
+	respListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer respListener.Close()
+	go serveRESP(respListener)
+	conn, err := net.Dial("tcp", respListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	redis := &respClient{conn: conn, reader: bufio.NewReader(conn)}
+	for _, step := range []struct {
+		args  []string
+		reply interface{}
+	}{
+		{[]string{"LLEN", "public"}, respError("NOAUTH Authentication required")},
+		{[]string{"AUTH", "wrong"}, respError("WRONGPASS invalid username-password pair or token")},
+		{[]string{"AUTH", "alice-token"}, "OK"},
+		{[]string{"LLEN", "public"}, 1},
+		{[]string{"LPUSH", "orders", "x"}, 1},
+		{[]string{"DEL", "orders", "public"}, respError("NOPERM no permissions to access 'orders' stack")},
+		{[]string{"KEYS", "*"}, respError("NOPERM no permissions to access all stacks")},
+	} {
+		if reply := redis.do(t, step.args...); !reflect.DeepEqual(reply, step.reply) {
+			t.Fatalf("%v: expected %#v, got %#v", step.args, step.reply, reply)
+		}
+	}
+	// Large requests are rejected before authentication
+	for _, request := range []string{"*1000\r\n", "*1\r\n$1000000\r\n"} {
+		anonymous, err := net.Dial("tcp", respListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = anonymous.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := (&respClient{conn: anonymous, reader: bufio.NewReader(anonymous)}).read()
+		anonymous.Close()
+		if err != nil || reply != respError(errRESPProtocol.Error()) {
+			t.Fatalf("%q: protocol error expected, got %#v %v", request, reply, err)
+		}
+	}
+
+	// Client certificate
+	ca := newTestCA(t)
+	tlsServer := httptest.NewUnstartedServer(newRouter())
+	tlsServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1")},
+		ClientCAs:    ca.pool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	carol := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      ca.pool(),
+		Certificates: []tls.Certificate{ca.issue(t, "carol")},
+	}}}
+	res, err := carol.Get(tlsServer.URL + "/public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Read by client certificate is not allowed", res.Status)
+	}
+	res, err = carol.Post(tlsServer.URL+"/orders", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatal("Push by client certificate is not denied", res.Status)
+	}
+}
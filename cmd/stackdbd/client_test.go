@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+	"github.com/reddec/file-stack-db/client"
+)
+
+// RPC server which tracks accepted connections
+type rpcTestServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func newRPCTestServer(t *testing.T) *rpcTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	server.RegisterName("db", new(Service))
+	srv := &rpcTestServer{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.lock.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.accepted++
+			srv.lock.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+	return srv
+}
+
+// Drop all connections as on server restart
+func (srv *rpcTestServer) drop() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *rpcTestServer) close() {
+	srv.listener.Close()
+	srv.drop()
+}
+
+func testClient(t *testing.T, name string, c *client.Client) {
+	section := "client-" + name
+	push := api.PushArgs{Section: section}
+	push.Headers = map[string]string{"Name": "Alex"}
+	push.Body = []byte("Hello world")
+	var depth int
+	if err := c.Push(push, &depth); err != nil || depth != 1 {
+		t.Fatal(name, "bad push", depth, err)
+	}
+	var pushed api.PushResult
+	if err := c.PushSync(push, &pushed); err != nil || pushed.DepthIndex != 2 || pushed.Durability != "none" {
+		t.Fatal(name, "bad push", pushed, err)
+	}
+	var batch []api.PushResult
+	if err := c.PushBatch([]api.PushArgs{push}, &batch); err != nil || len(batch) != 1 || batch[0].DepthIndex != 3 {
+		t.Fatal(name, "bad batch", batch, err)
+	}
+	var data api.DataResult
+	if err := c.Peak(section, &data); err != nil || data.DepthIndex != 3 || string(data.Body) != "Hello world" {
+		t.Fatal(name, "bad peak", data, err)
+	}
+	if data.Headers["Name"] != "Alex" {
+		t.Fatal(name, "bad headers", data.Headers)
+	}
+	if err := c.Get(api.IndexArgs{Section: section, DepthIndex: 1}, &data); err != nil || data.DepthIndex != 1 {
+		t.Fatal(name, "bad get", data, err)
+	}
+	var history []api.DataResult
+	if err := c.History(api.HistoryArgs{Section: section, Limit: 2}, &history); err != nil || len(history) != 2 || history[0].DepthIndex != 3 {
+		t.Fatal(name, "bad history", history, err)
+	}
+	if err := c.Move(api.MoveArgs{Section: section, To: section + "-moved"}, &data); err != nil || data.DepthIndex != 1 {
+		t.Fatal(name, "bad move", data, err)
+	}
+	for i := 2; i > 0; i-- {
+		if err := c.Pop(section, &data); err != nil || data.DepthIndex != i {
+			t.Fatal(name, "bad pop", data, err)
+		}
+	}
+	// Typed errors
+	if err := c.Pop(section, &data); err != api.ErrStackIsEmpty {
+		t.Fatal(name, "expected empty stack error, got", err)
+	}
+	if err := c.Peak("missing", &data); err != api.ErrSectionNotFound {
+		t.Fatal(name, "expected section not found error, got", err)
+	}
+	// Parent section is a file of other application
+	if err := ioutil.WriteFile("test-data/clientdb/notes-"+name, []byte("This is not a stack"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test-data/clientdb/notes-" + name)
+	if err := c.PushSync(api.PushArgs{Section: "notes-" + name + "/today"}, &pushed); err != api.ErrNotStack {
+		t.Fatal(name, "expected not a stack error, got", err)
+	}
+	// Context timeout
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := c.WithContext(ctx).PopWait(api.PopWaitArgs{Section: section, Timeout: time.Second}, &data)
+	if err == nil || time.Since(started) > 900*time.Millisecond {
+		t.Fatal(name, "call is not canceled by context", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/clientdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+
+	srv := newRPCTestServer(t)
+	defer srv.close()
+	rpcClient := client.NewRPC(srv.listener.Addr().String(), client.PoolSize(2))
+	defer rpcClient.Close()
+	testClient(t, "rpc", rpcClient)
+
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("db", new(Service))
+	httpRPC := httptest.NewServer(rpcServer)
+	defer httpRPC.Close()
+	httpRPCClient := client.NewHTTPRPC(httpRPC.Listener.Addr().String())
+	defer httpRPCClient.Close()
+	testClient(t, "http-rpc", httpRPCClient)
+
+	httpServer := httptest.NewServer(newRouter())
+	defer httpServer.Close()
+	httpClient := client.NewHTTP(httpServer.URL, client.Timeout(10*time.Second))
+	defer httpClient.Close()
+	testClient(t, "http", httpClient)
+	var sections []api.Section
+	if err := httpClient.Sections("client-http-m", &sections); err != nil || len(sections) != 1 || sections[0].Depth != 1 {
+		t.Fatal("Bad sections", sections, err)
+	}
+	var ranges []api.DataResult
+	if err := httpClient.Range(api.RangeArgs{Section: "client-http", From: 1, To: 1}, &ranges); err != client.ErrNotSupported {
+		t.Fatal("Ranges are not supported by HTTP API", err)
+	}
+
+	// Reconnect after server restart
+	srv.drop()
+	time.Sleep(100 * time.Millisecond)
+	if err := rpcClient.Sections("client-", &sections); err != nil || len(sections) == 0 {
+		t.Fatal("Client is not reconnected", err)
+	}
+	// Pool limits number of connections
+	srv.drop()
+	time.Sleep(100 * time.Millisecond)
+	srv.lock.Lock()
+	before := srv.accepted
+	srv.lock.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var data api.DataResult
+			if err := rpcClient.PopWait(api.PopWaitArgs{Section: "client-rpc", Timeout: 10 * time.Millisecond}, &data); err != api.ErrStackIsEmpty {
+				t.Error("Unexpected error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if opened := srv.accepted - before; opened > 2 {
+		t.Fatal("Too many connections:", opened)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+)
+
+// Codec of headers of stacks which have messages without recorded codec
+const defaultCodec = "json"
+
+// Codecs of new stacks in sections from command line: section=codec
+type codecFlags map[string]string
+
+func (cf codecFlags) String() string {
+	var items []string
+	for section, codec := range cf {
+		items = append(items, section+"="+codec)
+	}
+	sort.Strings(items)
+	return strings.Join(items, " ")
+}
+
+func (cf codecFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return errors.New("header codec must be in format section=codec")
+	}
+	if _, ok := api.LookupHeaderCodec(parts[1]); !ok {
+		return errors.New("unknown header codec " + parts[1])
+	}
+	cf[fstack.CleanKey(parts[0])] = parts[1]
+	return nil
+}
+
+// The most specific codec of section. Empty section means whole database
+func (cf codecFlags) of(key string) string {
+	for key = fstack.CleanKey(key); ; {
+		if codec, ok := cf[key]; ok {
+			return codec
+		}
+		if key == "" {
+			return defaultCodec
+		}
+		if pos := strings.LastIndex(key, fstack.SectionSeparator); pos != -1 {
+			key = key[:pos]
+		} else {
+			key = ""
+		}
+	}
+}
+
+var sectionCodecs = codecFlags{}
+
+// Name of header codec of stack: recorded in stack metadata, JSON for stacks with messages without
+// recorded codec or configured for section. Codec of new (or empty) stack is recorded if record is true
+func stackCodec(key string, record bool) (string, error) {
+	meta, err := db.Meta(key)
+	if err != nil && err != fstack.ErrNotFound {
+		return "", err
+	}
+	if codec, ok := meta[api.HeaderCodecMeta]; ok {
+		return codec, nil
+	}
+	codec := sectionCodecs.of(key)
+	if err == nil {
+		if stack, _ := db.Find(key, false); stack != nil && stack.Depth() > 0 {
+			codec = defaultCodec
+		}
+	}
+	if record {
+		return codec, db.SetMeta(key, api.HeaderCodecMeta, codec)
+	}
+	return codec, nil
+}
+
+// Encode headers of message pushed to stack by codec of stack
+func encodeHeaders(key string, headers map[string][]string) ([]byte, error) {
+	codec, err := stackCodec(key, true)
+	if err != nil {
+		return nil, err
+	}
+	encoder, ok := api.LookupHeaderCodec(codec)
+	if !ok {
+		return nil, errors.New("unknown header codec " + codec)
+	}
+	if headers == nil {
+		headers = map[string][]string{}
+	}
+	return encoder.Encode(headers)
+}
+
+// Decode stored headers by codec of stack. Raw headers are returned if stack is not JSON-encoded or
+// headers can't be decoded (or codec is not registered)
+func decodeHeaders(key string, data []byte) (map[string][]string, []byte) {
+	codec, err := stackCodec(key, false)
+	if err != nil {
+		return nil, data
+	}
+	if len(data) == 0 {
+		if codec == "raw" {
+			return nil, nil
+		}
+		return map[string][]string{}, nil
+	}
+	decoder, ok := api.LookupHeaderCodec(codec)
+	if !ok {
+		return nil, data
+	}
+	headers, err := decoder.Decode(data)
+	if err != nil {
+		return nil, data
+	}
+	if codec != "json" {
+		return headers, data
+	}
+	return headers, nil
+}
+
+// Stored headers of API message: raw headers as is, other headers by codec of stack
+func encodeMessage(key string, msg api.Message) ([]byte, error) {
+	if msg.RawHeaders != nil {
+		return msg.RawHeaders, nil
+	}
+	return encodeHeaders(key, api.SplitValues(msg.Headers))
+}
+
+// API message of stored message
+func decodeMessage(key string, header, body []byte) api.Message {
+	headers, raw := decodeHeaders(key, header)
+	return api.Message{Headers: api.JoinValues(headers), RawHeaders: raw, Body: body}
+}
+
+// Check that message can be moved between stacks without conversion of headers.
+// Codec of new destination is recorded if there is a message to move
+func checkMove(from, to string) error {
+	if stack, _ := db.Find(from, false); stack == nil || stack.Depth() == 0 {
+		return nil
+	}
+	source, err := stackCodec(from, false)
+	if err != nil {
+		return err
+	}
+	destination, err := stackCodec(to, true)
+	if err != nil {
+		return err
+	}
+	if source != destination {
+		return api.ErrHeaderCodec
+	}
+	return nil
+}
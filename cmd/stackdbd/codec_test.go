@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+)
+
+func TestHeaderCodecs(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/codecdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	for _, flag := range []string{"packed=msgpack", "multi=multi", "blobs=raw"} {
+		if err = sectionCodecs.Set(flag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() { sectionCodecs = codecFlags{} }()
+	if err = sectionCodecs.Set("bad=xml"); err == nil {
+		t.Fatal("Unknown codec is accepted")
+	}
+
+	srv := new(Service)
+	var pushed int
+	var data api.DataResult
+	for _, c := range []struct {
+		section string
+		headers map[string]string
+		raw     bool
+	}{
+		{"plain", map[string]string{"Name": "Alex"}, false},
+		{"packed/a", map[string]string{"Name": "Alex"}, true},
+		{"multi", map[string]string{"Name": "Alex"}, true},
+		{"blobs", nil, false},
+	} {
+		push := api.PushArgs{Section: c.section}
+		push.Headers = map[string]string{"Name": "Alex"}
+		push.Body = []byte("body")
+		if err = srv.Push(push, &pushed); err != nil {
+			t.Fatal(c.section, err)
+		}
+		if err = srv.Peak(c.section, &data); err != nil {
+			t.Fatal(c.section, err)
+		}
+		if !reflect.DeepEqual(data.Headers, c.headers) || (data.RawHeaders != nil) != c.raw || string(data.Body) != "body" {
+			t.Fatal(c.section, "bad message", data.Headers, data.RawHeaders)
+		}
+	}
+	// Codec is recorded in stack metadata and kept after configuration change
+	sectionCodecs["packed"] = "json"
+	if meta, err := db.Meta("packed/a"); err != nil || meta[api.HeaderCodecMeta] != "msgpack" {
+		t.Fatal("Codec is not recorded", meta, err)
+	}
+	if err = srv.Peak("packed/a", &data); err != nil || data.Headers["Name"] != "Alex" {
+		t.Fatal("Recorded codec is not used", data.Headers, err)
+	}
+	// Raw headers are saved as is
+	push := api.PushArgs{Section: "blobs"}
+	push.RawHeaders = []byte{0xff, 0x00}
+	if err = srv.Push(push, &pushed); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Pop("blobs", &data); err != nil || !bytes.Equal(data.RawHeaders, push.RawHeaders) || data.Headers != nil {
+		t.Fatal("Bad raw headers", data, err)
+	}
+	// Headers of other file-stack users are returned as raw
+	if _, err = db.Push("legacy", []byte{0xff}, []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Peak("legacy", &data); err != nil || !bytes.Equal(data.RawHeaders, []byte{0xff}) {
+		t.Fatal("Bad headers of other writer", data, err)
+	}
+	// Move only between sections with the same codec
+	if err = srv.Move(api.MoveArgs{Section: "packed/a", To: "plain"}, &data); err != api.ErrHeaderCodec {
+		t.Fatal("Expected header codec error, got", err)
+	}
+
+	// HTTP API
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	req, _ := http.NewRequest("POST", server.URL+"/multi", strings.NewReader("data"))
+	req.Header.Add("S-Tag", "a, b")
+	req.Header.Add("S-Tag", "c")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res, err = http.Get(server.URL + "/multi"); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if !reflect.DeepEqual(res.Header["S-Tag"], []string{"a, b", "c"}) {
+		t.Fatal("Repeated headers are not kept", res.Header)
+	}
+	if res, err = http.Get(server.URL + "/legacy"); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Raw-Headers") != "/w==" {
+		t.Fatal("Bad raw headers", res.Status, res.Header)
+	}
+	if res, err = http.Post(server.URL+"/_move/multi?to=plain", "text/plain", nil); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Fatal("Move between codecs is not rejected", res.Status)
+	}
+}
+
+// Header names are stored as lines
+type linesCodec struct{}
+
+func (linesCodec) Encode(headers map[string][]string) ([]byte, error) {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return []byte(strings.Join(names, "\n")), nil
+}
+
+func (linesCodec) Decode(data []byte) (map[string][]string, error) {
+	headers := map[string][]string{}
+	for _, name := range strings.Split(string(data), "\n") {
+		headers[name] = []string{"yes"}
+	}
+	return headers, nil
+}
+
+func TestCustomHeaderCodec(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/customcodecdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	if _, ok := api.LookupHeaderCodec("lines"); !ok {
+		api.RegisterHeaderCodec("lines", linesCodec{})
+	}
+	if err = sectionCodecs.Set("flags=lines"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { sectionCodecs = codecFlags{} }()
+
+	srv := new(Service)
+	var pushed int
+	push := api.PushArgs{Section: "flags"}
+	push.Headers = map[string]string{"B": "1", "A": "2"}
+	if err = srv.Push(push, &pushed); err != nil {
+		t.Fatal(err)
+	}
+	segment, err := db.Peak("flags")
+	if err != nil || string(segment.Header) != "A\nB" {
+		t.Fatal("Headers are not encoded by registered codec", string(segment.Header), err)
+	}
+	var data api.DataResult
+	if err = srv.Pop("flags", &data); err != nil || data.Headers["A"] != "yes" || !bytes.Equal(data.RawHeaders, segment.Header) {
+		t.Fatal("Headers are not decoded by registered codec", data, err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+	"github.com/reddec/file-stack-db/api/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// gRPC service over the same database as other listeners
+type grpcService struct {
+	pb.UnimplementedStackDBServer
+}
+
+// Convert database errors to gRPC status
+func grpcError(err error) error {
+	switch err {
+	case fstack.ErrNotFound, fstack.ErrEmpty:
+		return status.Error(codes.NotFound, apiError(err).Error())
+	case fstack.ErrOutOfRange:
+		return status.Error(codes.OutOfRange, apiError(err).Error())
+	case fstack.ErrCorrupted:
+		return status.Error(codes.DataLoss, apiError(err).Error())
+	case fstack.ErrNotStack:
+		return status.Error(codes.FailedPrecondition, apiError(err).Error())
+	case fstack.ErrInvalidKey:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case api.ErrUnauthorized:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case api.ErrAccessDenied:
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Message with headers decoded by codec of section and raw headers as in api.Message
+func grpcMessage(section string, segment fstack.Segment) *pb.Message {
+	msg := decodeMessage(section, segment.Header, segment.Data)
+	return &pb.Message{DepthIndex: int64(segment.Depth), Headers: msg.Headers, RawHeaders: msg.RawHeaders, Body: msg.Body}
+}
+
+func (srv *grpcService) Sections(ctx context.Context, req *pb.SectionsRequest) (*pb.SectionsResponse, error) {
+	log.Println("[GRPC] Sections with prefix", req.Prefix)
+	var sections []api.Section
+	if err := (&Service{session: contextSession(ctx)}).Sections(req.Prefix, &sections); err != nil {
+		return nil, grpcError(err)
+	}
+	res := &pb.SectionsResponse{}
+	for _, section := range sections {
+		res.Sections = append(res.Sections, &pb.Section{Name: section.Name, Depth: int64(section.Depth),
+			LastAccess: timestamppb.New(section.LastAccess)})
+	}
+	return res, nil
+}
+
+func (srv *grpcService) Push(ctx context.Context, req *pb.PushRequest) (*pb.PushResponse, error) {
+	log.Println("[GRPC] Push to", req.Section, "headers:", len(req.Headers), "items, body:", len(req.Body), "bytes")
+	if err := contextSession(ctx).check(req.Section, rightPush); err != nil {
+		return nil, grpcError(err)
+	}
+	headers, err := encodeHeaders(req.Section, api.SplitValues(req.Headers))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	depth, err := db.Push(req.Section, headers, req.Body)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.PushResponse{DepthIndex: int64(depth), Durability: db.SyncMode().String()}, nil
+}
+
+func (srv *grpcService) BulkPush(stream pb.StackDB_BulkPushServer) error {
+	var batch []api.PushArgs
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = contextSession(stream.Context()).check(req.Section, rightPush); err != nil {
+			return grpcError(err)
+		}
+		msg := api.PushArgs{Section: req.Section}
+		msg.Headers = req.Headers
+		msg.Body = req.Body
+		batch = append(batch, msg)
+	}
+	// Whole stream is one batch: messages are not pushed partially
+	log.Println("[GRPC] Bulk push of", len(batch), "messages")
+	results, err := pushBatch(batch)
+	if err != nil {
+		return grpcError(err)
+	}
+	res := &pb.BulkPushResponse{}
+	for _, result := range results {
+		res.Results = append(res.Results, &pb.PushResponse{DepthIndex: int64(result.DepthIndex), Durability: result.Durability})
+	}
+	return stream.SendAndClose(res)
+}
+
+func (srv *grpcService) Peak(ctx context.Context, req *pb.SectionRequest) (*pb.Message, error) {
+	log.Println("[GRPC] Peak from", req.Section)
+	if err := contextSession(ctx).check(req.Section, rightRead); err != nil {
+		return nil, grpcError(err)
+	}
+	segment, err := db.Peak(req.Section)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcMessage(req.Section, segment), nil
+}
+
+func (srv *grpcService) Pop(ctx context.Context, req *pb.SectionRequest) (*pb.Message, error) {
+	log.Println("[GRPC] Pop from", req.Section)
+	if err := contextSession(ctx).check(req.Section, rightPop); err != nil {
+		return nil, grpcError(err)
+	}
+	segment, err := db.Pop(req.Section)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcMessage(req.Section, segment), nil
+}
+
+func (srv *grpcService) History(ctx context.Context, req *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	log.Println("[GRPC] History of", req.Section, "offset", req.Offset, "limit", req.Limit, "ascending", req.Ascending)
+	if err := contextSession(ctx).check(req.Section, rightRead); err != nil {
+		return nil, grpcError(err)
+	}
+	segments, err := db.History(req.Section, int(req.Offset), int(req.Limit), req.Ascending)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &pb.HistoryResponse{}
+	for _, segment := range segments {
+		res.Messages = append(res.Messages, grpcMessage(req.Section, segment))
+	}
+	return res, nil
+}
+
+func (srv *grpcService) Watch(req *pb.WatchRequest, stream pb.StackDB_WatchServer) error {
+	if err := contextSession(stream.Context()).check(req.Prefix, rightRead); err != nil {
+		return grpcError(err)
+	}
+	watcher := db.Watch(req.Prefix)
+	defer watcher.Close()
+	log.Println("[GRPC] Watch", req.Prefix)
+	for {
+		select {
+		case event := <-watcher.Events:
+			err := stream.Send(&pb.Event{Type: string(event.Type), Section: event.Key, Depth: int64(event.Depth),
+				Time: timestamppb.New(event.Time)})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			log.Println("[GRPC] Stop watching", req.Prefix)
+			return nil
+		}
+	}
+}
+
+// Authenticate call by authorization metadata (Bearer token or Basic credentials) or client certificate
+func grpcSession(ctx context.Context) (context.Context, error) {
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		authorization = md.Get("authorization")[0]
+	}
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	s, err := newSession(authorization, state)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return withSession(ctx, s), nil
+}
+
+// Server stream with authenticated context
+type grpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *grpcStream) Context() context.Context { return stream.ctx }
+
+// gRPC server. TLS is handled by gRPC credentials to get client certificates of calls
+func newGRPCServer() *grpc.Server {
+	var opts []grpc.ServerOption
+	if serverTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLS.config("h2"))))
+	}
+	server := grpc.NewServer(append(opts,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := grpcSession(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := grpcSession(stream.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, &grpcStream{ServerStream: stream, ctx: ctx})
+		}))...)
+	pb.RegisterStackDBServer(server, &grpcService{})
+	return server
+}
+
+func enableGRPC(endpoint string) {
+	l, e := net.Listen("tcp", endpoint)
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+	panic(newGRPCServer().Serve(l))
+}
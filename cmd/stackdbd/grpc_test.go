@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPC(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/grpcdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newGRPCServer()
+	go server.Serve(l)
+	defer server.Stop()
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewStackDBClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	watch, err := client.Watch(ctx, &pb.WatchRequest{Prefix: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for subscription on server
+	time.Sleep(200 * time.Millisecond)
+
+	pushed, err := client.Push(ctx, &pb.PushRequest{Section: "test", Headers: map[string]string{"Name": "Alex"}, Body: []byte("Hello world")})
+	if err != nil || pushed.DepthIndex != 1 {
+		t.Fatal("Bad push", pushed, err)
+	}
+	event, err := watch.Recv()
+	if err != nil || event.Type != "push" || event.Section != "test" || event.Depth != 1 {
+		t.Fatal("Bad event", event, err)
+	}
+
+	count := 300
+	bulk, err := client.BulkPush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err = bulk.Send(&pb.PushRequest{Section: "bulk", Body: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bulkResult, err := bulk.CloseAndRecv()
+	if err != nil || len(bulkResult.Results) != count || bulkResult.Results[count-1].DepthIndex != int64(count) {
+		t.Fatal("Bad bulk push", err)
+	}
+
+	sections, err := client.Sections(ctx, &pb.SectionsRequest{Prefix: "te"})
+	if err != nil || len(sections.Sections) != 1 || sections.Sections[0].Name != "test" || sections.Sections[0].Depth != 1 {
+		t.Fatal("Bad sections", sections, err)
+	}
+	message, err := client.Peak(ctx, &pb.SectionRequest{Section: "test"})
+	if err != nil || string(message.Body) != "Hello world" || message.Headers["Name"] != "Alex" {
+		t.Fatal("Bad peak", message, err)
+	}
+	history, err := client.History(ctx, &pb.HistoryRequest{Section: "bulk", Limit: 2})
+	if err != nil || len(history.Messages) != 2 || history.Messages[0].Body[0] != byte(count-1) {
+		t.Fatal("Bad history", err)
+	}
+	message, err = client.Pop(ctx, &pb.SectionRequest{Section: "test"})
+	if err != nil || message.DepthIndex != 1 {
+		t.Fatal("Bad pop", message, err)
+	}
+	if _, err = client.Pop(ctx, &pb.SectionRequest{Section: "test"}); status.Code(err) != codes.NotFound {
+		t.Fatal("NotFound expected for empty stack", err)
+	}
+	if _, err = client.Peak(ctx, &pb.SectionRequest{Section: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatal("NotFound expected for unknown section", err)
+	}
+}
+
+func TestGRPCRawHeaders(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/grpcrawdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newGRPCServer()
+	go server.Serve(l)
+	defer server.Stop()
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewStackDBClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Headers of other file-stack users can't be decoded
+	if _, err = db.Push("legacy", []byte{0xff}, []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	message, err := client.Peak(ctx, &pb.SectionRequest{Section: "legacy"})
+	if err != nil || !bytes.Equal(message.RawHeaders, []byte{0xff}) || len(message.Headers) != 0 {
+		t.Fatal("Raw headers are not transferred", message, err)
+	}
+	if _, err = client.Push(ctx, &pb.PushRequest{Section: "plain", Headers: map[string]string{"Name": "Alex"}}); err != nil {
+		t.Fatal(err)
+	}
+	message, err = client.Pop(ctx, &pb.SectionRequest{Section: "plain"})
+	if err != nil || message.RawHeaders != nil || message.Headers["Name"] != "Alex" {
+		t.Fatal("Raw headers of JSON section are transferred", message, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Name of message header which keeps media type of pushed body
+const contentTypeHeader = "Content-Type"
+
+// HTTP header with base64 of raw message headers (see api.Message)
+const rawHeadersHeader = "Raw-Headers"
+
+// Mapping between HTTP headers and message headers
+type headerMapping struct {
+	prefix string          // headers with prefix are saved without prefix. Empty - prefixed headers are not saved
+	allow  map[string]bool // canonical names of headers saved as is
+}
+
+var headerMap = headerMapping{prefix: "S-", allow: map[string]bool{}}
+
+// Mapping with prefix and comma-separated allow-list of header names
+func newHeaderMapping(prefix, allowList string) headerMapping {
+	mapping := headerMapping{prefix: http.CanonicalHeaderKey(prefix), allow: map[string]bool{}}
+	for _, name := range strings.Split(allowList, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			mapping.allow[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return mapping
+}
+
+// Message headers from request: headers with prefix (without prefix), allowed headers and content type
+func (m headerMapping) read(header http.Header) map[string][]string {
+	res := map[string][]string{}
+	for key, values := range header {
+		var name string
+		switch {
+		case m.allow[key]:
+			name = key
+		case m.prefix != "" && strings.HasPrefix(key, m.prefix) && len(key) > len(m.prefix):
+			name = key[len(m.prefix):]
+		default:
+			continue
+		}
+		res[name] = values
+	}
+	if contentType := header.Get(contentTypeHeader); contentType != "" {
+		res[contentTypeHeader] = []string{contentType}
+	}
+	return res
+}
+
+// Write message headers to response in the same way as they were read
+func (m headerMapping) write(header http.Header, message map[string][]string) {
+	for key, values := range message {
+		var name string
+		switch {
+		case http.CanonicalHeaderKey(key) == contentTypeHeader || m.allow[http.CanonicalHeaderKey(key)]:
+			name = key
+		case m.prefix != "":
+			name = m.prefix + key
+		default:
+			continue
+		}
+		header.Del(name)
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+}
+
+// Headers of pushed message in stored form: raw headers (base64) as is, other headers by codec of stack
+func (m headerMapping) encode(key string, header http.Header) ([]byte, error) {
+	if raw := header.Get(rawHeadersHeader); raw != "" {
+		return base64.StdEncoding.DecodeString(raw)
+	}
+	return encodeHeaders(key, m.read(header))
+}
+
+// Write stored headers of message to response. Headers which can't be decoded are returned as base64
+func (m headerMapping) decode(key string, header http.Header, data []byte) {
+	headers, raw := decodeHeaders(key, data)
+	m.write(header, headers)
+	if headers == nil && len(raw) > 0 {
+		header.Set(rawHeadersHeader, base64.StdEncoding.EncodeToString(raw))
+	}
+}
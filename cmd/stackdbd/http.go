@@ -2,62 +2,105 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
 )
 
-func encodeHeaders(headers map[string]string) []byte {
-	v, err := json.Marshal(headers)
-	if err != nil {
-		panic(err)
+// Default number of messages in history response
+const defaultHistoryLimit = 50
+
+// Write error as JSON with code. Code of bad request is "invalid", other codes are taken from error.
+// File which is not a stack is always reported as conflict
+func writeError(w http.ResponseWriter, err error, status int) {
+	err = apiError(err)
+	if err == api.ErrNotStack {
+		status = http.StatusConflict
+	}
+	body := api.ErrorBody{Code: api.ErrorCode(err), Message: err.Error()}
+	if status == http.StatusBadRequest {
+		body.Code = api.CodeInvalid
 	}
-	return v
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", auth.challenge())
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
 }
 
-func decodeHeaders(data []byte) map[string]string {
-	var v map[string]string
-	err := json.Unmarshal(data, &v)
-	if err != nil {
-		panic(err)
+// Size of the first part of streamed body which is read before response status. Errors of shorter bodies
+// (for example, corrupted message) are returned as error response, response of longer bodies is aborted
+const streamHead = 32 * 1024
+
+// Request body which keeps read error to distinguish it from storage errors
+type requestBody struct {
+	io.Reader
+	err error
+}
+
+func (rb *requestBody) Read(p []byte) (int, error) {
+	n, err := rb.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		rb.err = err
 	}
-	return v
+	return n, err
+}
+
+// First part of streamed body (see streamHead)
+func readHead(stream io.Reader) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(stream, streamHead))
 }
+
+// Write status, first part and rest of streamed body
+func writeStream(w http.ResponseWriter, head []byte, stream io.Reader) error {
+	w.WriteHeader(200)
+	w.Write(head)
+	_, err := io.Copy(w, stream)
+	return err
+}
+
+// Abort response which status is already written. Client gets broken response instead of damaged body
+func abortStream(section string, err error) {
+	log.Println("[STREAM]", "Failed send body of", section, err)
+	panic(http.ErrAbortHandler)
+}
+
 func pushData(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	data, err := ioutil.ReadAll(r.Body)
+	binHeaders, err := headerMap.encode(vars["key"], r.Header)
 	if err != nil {
-		log.Println("[PUSH]", "Failed read body from request for stack", vars["key"], err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println("[PUSH]", "Failed encode headers for stack", vars["key"], err)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
-	headers := map[string]string{}
-	for key, value := range r.Header {
-		if strings.HasPrefix("S-", key) {
-			headers[key[2:]] = value[0]
-		}
-	}
-	stack, err := db.Find(vars["key"], true)
-	if err != nil {
-		log.Println("[PUSH]", "Failed find stack", vars["key"], err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Body is written to stack as it is received: size is unknown for chunked request
+	body := &requestBody{Reader: r.Body}
+	depth, err := db.PushFrom(vars["key"], binHeaders, body, r.ContentLength)
+	if body.err != nil || err == io.ErrUnexpectedEOF {
+		log.Println("[PUSH]", "Failed read body from request for stack", vars["key"], err)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
-	binHeaders := encodeHeaders(headers)
-
-	depth, err := stack.Push(binHeaders, data)
 	if err != nil {
 		log.Println("[PUSH]", "Failed push to", vars["key"], err)
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		writeError(w, err, http.StatusBadGateway)
 		return
 	}
 	sdepth := strconv.Itoa(depth)
-	log.Println("[PUSH]", "Pushed", len(data), "bytes with headers", len(binHeaders), "bytes to", vars["key"], "with depth-index", sdepth)
+	log.Println("[PUSH]", "Pushed body with headers", len(binHeaders), "bytes to", vars["key"], "with depth-index", sdepth)
 	w.Header().Add("Id", sdepth)
+	w.Header().Add("Durability", db.SyncMode().String())
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(200)
@@ -66,77 +109,378 @@ func pushData(w http.ResponseWriter, r *http.Request) {
 
 func getLast(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	stack, err := db.Find(vars["key"], false)
-	if err != nil {
-		log.Println("[PEAK]", "Failed find stack", vars["key"], err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	stream, err := db.Open(vars["key"], 0)
+	if err == fstack.ErrNotFound {
+		log.Println("[PEAK]", "Stack", vars["key"], "not exists")
+		writeError(w, err, http.StatusNotFound)
 		return
 	}
-	if stack == nil {
-		log.Println("[PEAK]", "Stack", vars["key"], "not exists")
-		http.Error(w, "", http.StatusNotFound)
+	if err == fstack.ErrEmpty {
+		log.Println("[PEAK]", "Stack", vars["key"], "is empty")
+		writeError(w, err, http.StatusNotFound)
 		return
 	}
-	headers, body, err := stack.Peak()
 	if err != nil {
 		log.Println("[PEAK]", "Failed peak stack", vars["key"], err)
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		writeError(w, err, http.StatusBadGateway)
 		return
 	}
-	if headers == nil || body == nil {
-		log.Println("[PEAK]", "Stack", vars["key"], "is empty")
-		http.Error(w, "", http.StatusNotFound)
+	defer stream.Close()
+	head, err := readHead(stream)
+	if err != nil {
+		log.Println("[PEAK]", "Failed peak stack", vars["key"], err)
+		writeError(w, err, http.StatusBadGateway)
 		return
 	}
-	sheaders := decodeHeaders(headers)
-	for key, value := range sheaders {
-		w.Header().Add("S-"+key, value)
+	headerMap.decode(vars["key"], w.Header(), stream.Header)
+	log.Println("[PEAK]", "Read stack", vars["key"], "headers:", len(stream.Header), "bytes, body:", stream.Size, "bytes")
+	w.Header().Add("Count", strconv.Itoa(stream.Depth))
+	if err = writeStream(w, head, stream); err != nil {
+		abortStream(vars["key"], err)
 	}
-	log.Println("[PEAK]", "Read stack", vars["key"], "headers:", len(headers), "bytes, body:", len(body), "bytes")
-	w.Header().Add("Count", strconv.Itoa(stack.Depth()))
-	w.WriteHeader(200)
-	w.Write(body)
 }
 
-func removeLast(w http.ResponseWriter, r *http.Request) {
+func getByIndex(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	stack, err := db.Find(vars["key"], false)
+	index, err := strconv.Atoi(vars["index"])
 	if err != nil {
-		log.Println("[POP]", "Failed find stack", vars["key"], err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
-	if stack == nil {
+	var stream *fstack.Stream
+	if index > 0 {
+		stream, err = db.Open(vars["key"], index)
+	} else {
+		err = fstack.ErrOutOfRange
+	}
+	if err == fstack.ErrNotFound || err == fstack.ErrOutOfRange {
+		log.Println("[GET]", "Stack", vars["key"], "has no index", index)
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("[GET]", "Failed get from stack", vars["key"], "at", index, err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	defer stream.Close()
+	head, err := readHead(stream)
+	if err != nil {
+		log.Println("[GET]", "Failed get from stack", vars["key"], "at", index, err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	headerMap.decode(vars["key"], w.Header(), stream.Header)
+	log.Println("[GET]", "Read stack", vars["key"], "at", index, "headers:", len(stream.Header), "bytes, body:", stream.Size, "bytes")
+	w.Header().Add("Id", vars["index"])
+	if stack, _ := db.Find(vars["key"], false); stack != nil {
+		w.Header().Add("Count", strconv.Itoa(stack.Depth()))
+	}
+	if err = writeStream(w, head, stream); err != nil {
+		abortStream(vars["key"], err)
+	}
+}
+
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	offset, limit := 0, defaultHistoryLimit
+	var err error
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+	}
+	if v := query.Get("limit"); v != "" && err == nil {
+		limit, err = strconv.Atoi(v)
+	}
+	order := query.Get("order")
+	if err == nil && order != "" && order != "asc" && order != "desc" {
+		err = errors.New("order must be asc or desc")
+	}
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	segments, err := db.History(vars["key"], offset, limit, order == "asc")
+	if err == fstack.ErrNotFound {
+		log.Println("[HISTORY]", "Stack", vars["key"], "not exists")
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("[HISTORY]", "Failed read history of", vars["key"], err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	log.Println("[HISTORY]", "Read", len(segments), "messages of", vars["key"], "from offset", offset)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(segmentsResult(vars["key"], segments))
+}
+
+func removeLast(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var timeout time.Duration
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		var err error
+		if timeout, err = time.ParseDuration(wait); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	// Message is removed only if body is sent (corrupted message is removed anyway)
+	var sent bool
+	err := db.PopStream(vars["key"], timeout, func(stream *fstack.Stream) error {
+		head, err := readHead(stream)
+		if err != nil {
+			return err
+		}
+		headerMap.decode(vars["key"], w.Header(), stream.Header)
+		log.Println("[POP]", "Read stack", vars["key"], "headers:", len(stream.Header), "bytes, body:", stream.Size, "bytes")
+		w.Header().Add("Count", strconv.Itoa(stream.Depth-1))
+		sent = true
+		return writeStream(w, head, stream)
+	})
+	if sent && err != nil {
+		abortStream(vars["key"], err)
+	}
+	if err == fstack.ErrNotFound {
 		log.Println("[POP]", "Stack", vars["key"], "not exists")
-		http.Error(w, "", http.StatusNotFound)
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	if err == fstack.ErrEmpty {
+		log.Println("[POP]", "Stack", vars["key"], "is empty")
+		writeError(w, err, http.StatusNotFound)
 		return
 	}
-	headers, body, err := stack.Pop()
 	if err != nil {
 		log.Println("[POP]", "Failed pop stack", vars["key"], err)
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		writeError(w, err, http.StatusBadGateway)
+	}
+}
+
+func compactStack(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	dropped, err := db.Compact(vars["key"])
+	if err == fstack.ErrNotFound {
+		log.Println("[COMPACT]", "Stack", vars["key"], "not exists")
+		writeError(w, err, http.StatusNotFound)
 		return
 	}
-	if headers == nil || body == nil {
-		log.Println("[POP]", "Stack", vars["key"], "is empty")
-		http.Error(w, "", http.StatusNotFound)
+	if err != nil {
+		log.Println("[COMPACT]", "Failed compact stack", vars["key"], err)
+		writeError(w, err, http.StatusBadGateway)
 		return
 	}
-	sheaders := decodeHeaders(headers)
-	for key, value := range sheaders {
-		w.Header().Add(key, value)
+	log.Println("[COMPACT]", "Compacted stack", vars["key"], "dropped", dropped, "segments")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write([]byte(strconv.Itoa(dropped)))
+}
+
+func pushMany(w http.ResponseWriter, r *http.Request) {
+	var batch []api.PushArgs
+	err := json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil {
+		log.Println("[BATCH]", "Failed decode batch", err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	for _, msg := range batch {
+		if err = contextSession(r.Context()).check(msg.Section, rightPush); err != nil {
+			writeError(w, err, authStatus(err))
+			return
+		}
+	}
+	res, err := pushBatch(batch)
+	if err == fstack.ErrInvalidKey {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("[BATCH]", "Failed push batch", err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	log.Println("[BATCH]", "Pushed", len(res), "messages")
+	w.Header().Add("Durability", db.SyncMode().String())
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+func moveLast(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		writeError(w, errors.New("destination section (to) is not specified"), http.StatusBadRequest)
+		return
+	}
+	if err := contextSession(r.Context()).check(to, rightPush); err != nil {
+		writeError(w, err, authStatus(err))
+		return
 	}
-	log.Println("[POP]", "Read stack", vars["key"], "headers:", len(headers), "bytes, body:", len(body), "bytes")
-	w.Header().Add("Count", strconv.Itoa(stack.Depth()))
+	if err := checkMove(vars["key"], to); err == api.ErrHeaderCodec {
+		writeError(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("[MOVE]", "Failed check header codecs of", vars["key"], "and", to, err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	segment, err := db.Move(vars["key"], to)
+	if err == fstack.ErrNotFound || err == fstack.ErrEmpty {
+		log.Println("[MOVE]", "Stack", vars["key"], "not exists or empty")
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	if err == fstack.ErrInvalidKey {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("[MOVE]", "Failed move from", vars["key"], "to", to, err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	headerMap.decode(to, w.Header(), segment.Header)
+	log.Println("[MOVE]", "Moved message from", vars["key"], "to", to, "with depth-index", segment.Depth)
+	w.Header().Add("Id", strconv.Itoa(segment.Depth))
 	w.WriteHeader(200)
-	w.Write(body)
+	w.Write(segment.Data)
 }
 
-func enableHTTP(bind string) {
+// List sections with prefix (from query) readable by client
+func listSections(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	// No right is required: only authentication is checked, sections are filtered by read right
+	if err := contextSession(r.Context()).check(prefix, 0); err != nil {
+		writeError(w, err, authStatus(err))
+		return
+	}
+	var sections []api.Section
+	err := (&Service{session: contextSession(r.Context())}).Sections(prefix, &sections)
+	if err != nil {
+		log.Println("[LIST]", "Failed list sections with prefix", prefix, err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Name < sections[j].Name })
+	log.Println("[LIST]", "Found", len(sections), "sections with prefix", prefix)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sections)
+}
+
+// Depth, size and last access time of stack in headers without body
+func headStack(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	stat, err := db.Stat(vars["key"])
+	if err == fstack.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("[HEAD]", "Failed read stack", vars["key"], err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.Header().Add("Count", strconv.Itoa(stat.Depth))
+	w.Header().Add("Size", strconv.FormatInt(stat.Size, 10))
+	// Access time is changed by reads, so time of last push is used
+	if !stat.LastPushed.IsZero() {
+		w.Header().Add("Last-Modified", stat.LastPushed.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Detailed info of stack as JSON
+func getMeta(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	stat, err := db.Stat(vars["key"])
+	if err == fstack.ErrNotFound {
+		log.Println("[META]", "Stack", vars["key"], "not exists")
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("[META]", "Failed read stack", vars["key"], err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	meta := api.SectionMeta{Size: stat.Size, Format: stat.Format, FirstPushed: stat.FirstPushed, LastPushed: stat.LastPushed}
+	meta.Name = fstack.CleanKey(vars["key"])
+	meta.Depth = stat.Depth
+	meta.LastAccess = stat.LastAccess
+	if meta.HeaderCodec, err = stackCodec(vars["key"], false); err != nil {
+		log.Println("[META]", "Failed read header codec of", vars["key"], err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(meta)
+}
+
+// Remove stack with all messages
+func removeStack(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	stat, err := db.Stat(vars["key"])
+	if err == nil {
+		err = db.Remove(vars["key"])
+	}
+	if err == fstack.ErrNotFound {
+		log.Println("[REMOVE]", "Stack", vars["key"], "not exists")
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	if err == fstack.ErrInvalidKey {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("[REMOVE]", "Failed remove stack", vars["key"], err)
+		writeError(w, err, http.StatusBadGateway)
+		return
+	}
+	log.Println("[REMOVE]", "Removed stack", vars["key"], "with", stat.Depth, "messages")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strconv.Itoa(stat.Depth)))
+}
+
+func compactAll(w http.ResponseWriter, r *http.Request) {
+	scheduled := db.ScheduleCompactAll()
+	log.Println("[COMPACT]", "Scheduled compaction of", scheduled, "stacks")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(strconv.Itoa(scheduled)))
+}
+
+// Router of HTTP API. Rights of request session are checked for section from path. Key may contain sub-sections,
+// so operations other than push, pop and peak have prefix path starting with "_": such top-level names are reserved
+func newRouter() http.Handler {
 	router := mux.NewRouter()
-	router.Methods("GET").Path("/{key}").HandlerFunc(getLast)
-	router.Methods("POST").Path("/{key}").HandlerFunc(pushData)
-	router.Methods("DELete").Path("/{key}").HandlerFunc(removeLast)
-	http.Handle("/", router)
-	panic(http.ListenAndServe(bind, nil))
+	router.Methods("GET").Path("/").HandlerFunc(listSections)
+	router.Methods("GET").Path("/_events").HandlerFunc(protect(rightRead, watchEvents))
+	router.Methods("GET").Path("/_ws").HandlerFunc(protect(rightRead, watchWebsocket))
+	router.Methods("POST").Path("/_batch").HandlerFunc(pushMany)
+	router.Methods("POST").Path("/_compact").HandlerFunc(protect(rightPop, compactAll))
+	router.Methods("POST").Path("/_compact/{key:.+}").HandlerFunc(protect(rightPop, compactStack))
+	router.Methods("GET").Path("/_meta/{key:.+}").HandlerFunc(protect(rightRead, getMeta))
+	router.Methods("GET").Path("/_history/{key:.+}").HandlerFunc(protect(rightRead, getHistory))
+	router.Methods("GET").Path("/_events/{key:.+}").HandlerFunc(protect(rightRead, watchEvents))
+	router.Methods("GET").Path("/_at/{index:[0-9]+}/{key:.+}").HandlerFunc(protect(rightRead, getByIndex))
+	router.Methods("POST").Path("/_move/{key:.+}").HandlerFunc(protect(rightPop, moveLast))
+	router.Methods("GET").Path("/{key:.+}").HandlerFunc(protect(rightRead, getLast))
+	router.Methods("HEAD").Path("/{key:.+}").HandlerFunc(protect(rightRead, headStack))
+	router.Methods("POST").Path("/{key:.+}").HandlerFunc(protect(rightPush, pushData))
+	router.Methods("DELETE").Path("/{key:.+}").Queries("all", "true").HandlerFunc(protect(rightPop, removeStack))
+	router.Methods("DELete").Path("/{key:.+}").HandlerFunc(protect(rightPop, removeLast))
+	return authenticate(router)
+}
+
+func enableHTTP(bind string) {
+	http.Handle("/", newRouter())
+	panic(http.Serve(listen(bind), nil))
 }
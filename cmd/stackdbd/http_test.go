@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+)
+
+func TestHTTPEvents(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/httpdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	// Server-Sent Events
+	res, err := http.Get(server.URL + "/_events/events-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Bad content type", res.Header.Get("Content-Type"))
+	}
+	// WebSocket
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /_ws?prefix=events-test HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	wsRes, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wsRes.StatusCode != http.StatusSwitchingProtocols || wsRes.Header.Get("Sec-Websocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("Bad websocket handshake", wsRes.Status, wsRes.Header)
+	}
+
+	_, err = http.Post(server.URL+"/events-test", "text/plain", bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event api.Event
+	lines := bufio.NewReader(res.Body)
+	line, err := lines.ReadString('\n')
+	if err != nil || line != "event: push\n" {
+		t.Fatal("Bad SSE event", line, err)
+	}
+	line, err = lines.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "data: ") {
+		t.Fatal("Bad SSE data", line, err)
+	}
+	if err = json.Unmarshal([]byte(line[6:]), &event); err != nil || event.Section != "events-test" || event.Depth != 1 {
+		t.Fatal("Bad SSE event data", line, err)
+	}
+
+	ws := &websocketConn{conn: conn, reader: reader}
+	opcode, payload, err := ws.ReadFrame()
+	if err != nil || opcode != wsText {
+		t.Fatal("Bad websocket frame", opcode, err)
+	}
+	if err = json.Unmarshal(payload, &event); err != nil || event.Type != "push" || event.Section != "events-test" {
+		t.Fatal("Bad websocket event", string(payload), err)
+	}
+}
+
+func TestHTTPBatch(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/httpbatchdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	batch := `[{"Section": "a", "Headers": {"Name": "x"}, "Body": "MQ=="}, {"Section": "b", "Body": "Mg=="}, {"Section": "a", "Body": "Mw=="}]`
+	res, err := http.Post(server.URL+"/_batch", "application/json", bytes.NewBufferString(batch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var results []api.PushResult
+	if err = json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].DepthIndex != 1 || results[1].DepthIndex != 1 || results[2].DepthIndex != 2 {
+		t.Fatal("Bad batch result", results)
+	}
+	if results[0].Durability != "none" || res.Header.Get("Durability") != "none" {
+		t.Fatal("Bad durability", results[0].Durability)
+	}
+	if segment, err := db.Peak("a"); err != nil || string(segment.Data) != "3" {
+		t.Fatal("Bad last message", err)
+	}
+	res, err = http.Post(server.URL+"/_batch", "application/json", bytes.NewBufferString("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatal("Bad request expected", res.Status)
+	}
+}
+
+func TestHTTPMove(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/httpmovedb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	if _, err = db.Push("inbox", []byte(`{"Name":"job"}`), []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(server.URL+"/_move/inbox?to=processing", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "payload" || res.Header.Get("S-Name") != "job" || res.Header.Get("Id") != "1" {
+		t.Fatal("Bad move response", res.Status, string(body), res.Header)
+	}
+	res, err = http.Post(server.URL+"/_move/inbox?to=processing", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errBody api.ErrorBody
+	err = json.NewDecoder(res.Body).Decode(&errBody)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || err != nil || errBody.Code != api.CodeEmpty {
+		t.Fatal("Empty stack expected", res.Status, errBody, err)
+	}
+	res, err = http.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(res.Body).Decode(&errBody)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || err != nil || errBody.Code != api.CodeNotFound || errBody.Message != api.ErrSectionNotFound.Error() {
+		t.Fatal("Section not found expected", res.Status, errBody, err)
+	}
+}
+
+func TestHTTPSections(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/httpsectionsdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	for _, key := range []string{"logs/app", "logs/web", "metrics"} {
+		if _, err = db.Push(key, nil, []byte("data of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := http.Get(server.URL + "/?prefix=logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sections []api.Section
+	err = json.NewDecoder(res.Body).Decode(&sections)
+	res.Body.Close()
+	if err != nil || len(sections) != 2 || sections[0].Name != "logs/app" || sections[1].Name != "logs/web" || sections[0].Depth != 1 {
+		t.Fatal("Bad sections", sections, err)
+	}
+	request := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	head := request("HEAD", "/metrics")
+	head.Body.Close()
+	if head.StatusCode != http.StatusOK || head.Header.Get("Count") != "1" || head.Header.Get("Size") == "" || head.Header.Get("Last-Modified") == "" {
+		t.Fatal("Bad HEAD response", head.Status, head.Header)
+	}
+	if res = request("HEAD", "/missing"); res.StatusCode != http.StatusNotFound {
+		t.Fatal("Not found expected", res.Status)
+	}
+	res = request("GET", "/_meta/metrics")
+	var meta api.SectionMeta
+	err = json.NewDecoder(res.Body).Decode(&meta)
+	res.Body.Close()
+	if err != nil || meta.Name != "metrics" || meta.Depth != 1 || meta.Size == 0 || meta.LastPushed.IsZero() {
+		t.Fatal("Bad meta", meta, err)
+	}
+	if lastModified := head.Header.Get("Last-Modified"); lastModified != meta.LastPushed.UTC().Format(http.TimeFormat) {
+		t.Fatal("Last-Modified must be time of last push", lastModified, meta.LastPushed)
+	}
+	// DELETE without all=true is pop
+	res = request("DELETE", "/metrics")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || db.Get("metrics").Depth() != 0 {
+		t.Fatal("Bad pop", res.Status)
+	}
+	db.Push("metrics", nil, []byte("value"))
+	res = request("DELETE", "/metrics?all=true")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "1" {
+		t.Fatal("Bad remove", res.Status, string(body))
+	}
+	if s, _ := db.Find("metrics", false); s != nil {
+		t.Fatal("Stack is not removed")
+	}
+	if res = request("DELETE", "/metrics?all=true"); res.StatusCode != http.StatusNotFound {
+		t.Fatal("Not found expected", res.Status)
+	}
+	// File of other application is not opened as stack
+	notes := []byte("This is not a stack")
+	if err = ioutil.WriteFile("test-data/httpsectionsdb/notes", notes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test-data/httpsectionsdb/notes")
+	res = request("GET", "/notes")
+	var errBody api.ErrorBody
+	json.NewDecoder(res.Body).Decode(&errBody)
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict || errBody.Code != api.CodeNotStack {
+		t.Fatal("Not a stack expected", res.Status, errBody)
+	}
+	if content, _ := ioutil.ReadFile("test-data/httpsectionsdb/notes"); !bytes.Equal(content, notes) {
+		t.Fatal("Not a stack file was changed:", string(content))
+	}
+}
+
+func TestHTTPNestedKey(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/httpnesteddb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	request := func(method, path string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(body)
+	}
+	// Names of sub-resources are valid names of sub-sections
+	for _, key := range []string{"sensors/room1", "sensors/room1/history", "sensors/room1/1"} {
+		if res, _ := request("POST", "/"+key); res.StatusCode != http.StatusOK {
+			t.Fatal("Bad push to", key, res.Status)
+		}
+	}
+	if _, err = db.Push("sensors/room1", nil, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if res, body := request("GET", "/sensors/room1"); res.StatusCode != http.StatusOK || body != "second" || res.Header.Get("Count") != "2" {
+		t.Fatal("Bad peak of nested key", res.Status, body, res.Header)
+	}
+	if res, _ := request("HEAD", "/sensors/room1/history"); res.StatusCode != http.StatusOK || res.Header.Get("Count") != "1" {
+		t.Fatal("Bad HEAD of nested key", res.Status, res.Header)
+	}
+	if res, body := request("GET", "/_at/2/sensors/room1"); res.StatusCode != http.StatusOK || body != "second" {
+		t.Fatal("Bad message by index", res.Status, body)
+	}
+	var meta api.SectionMeta
+	res, body := request("GET", "/_meta/sensors/room1")
+	if err = json.Unmarshal([]byte(body), &meta); err != nil || meta.Name != "sensors/room1" || meta.Depth != 2 {
+		t.Fatal("Bad meta of nested key", res.Status, body, err)
+	}
+	var history []api.DataResult
+	res, body = request("GET", "/_history/sensors/room1?limit=10")
+	if err = json.Unmarshal([]byte(body), &history); err != nil || len(history) != 2 {
+		t.Fatal("Bad history of nested key", res.Status, body, err)
+	}
+	if res, body = request("POST", "/_move/sensors/room1?to=archive/room1"); res.StatusCode != http.StatusOK || body != "second" {
+		t.Fatal("Bad move of nested key", res.Status, body)
+	}
+	if res, body = request("DELETE", "/sensors/room1"); res.StatusCode != http.StatusOK || res.Header.Get("Count") != "0" {
+		t.Fatal("Bad pop of nested key", res.Status, body)
+	}
+	if res, body = request("DELETE", "/sensors/room1/1?all=true"); res.StatusCode != http.StatusOK || body != "1" {
+		t.Fatal("Bad remove of nested key", res.Status, body)
+	}
+	if s, _ := db.Find("sensors/room1/history", false); s == nil || s.Depth() != 1 {
+		t.Fatal("Sibling section is changed")
+	}
+	if s, _ := db.Find("archive/room1", false); s == nil || s.Depth() != 1 {
+		t.Fatal("Message is not moved to nested key")
+	}
+}
+
+func TestHTTPHeaders(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/httpheadersdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	headerMap = newHeaderMapping("S-", "X-Trace-Id")
+	defer func() { headerMap = newHeaderMapping("S-", "") }()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	request := func(method string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+"/files", strings.NewReader(`{"x":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Add("S-Tag", "a")
+			req.Header.Add("S-Tag", "b")
+			req.Header.Set("X-Trace-Id", "42")
+			req.Header.Set("X-Other", "ignored")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := request("POST"); res.StatusCode != http.StatusOK {
+		t.Fatal("Bad push", res.Status)
+	}
+	segment, err := db.Peak("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"Content-Type":"application/json","Tag":"a, b","X-Trace-Id":"42"}`
+	if string(segment.Header) != expected {
+		t.Fatal("Bad saved headers", string(segment.Header))
+	}
+	// GET and DELETE return the same headers
+	for _, method := range []string{"GET", "DELETE"} {
+		res := request(method)
+		if res.StatusCode != http.StatusOK || res.Header.Get("S-Tag") != "a, b" || res.Header.Get("X-Trace-Id") != "42" ||
+			res.Header.Get("Content-Type") != "application/json" || res.Header.Get("X-Other") != "" {
+			t.Fatal(method, "bad headers", res.Status, res.Header)
+		}
+	}
+}
+
+func TestHTTPStream(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/httpstreamdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	// Chunked body of unknown size
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+	reader, writer := io.Pipe()
+	go func() {
+		for i := 0; i < len(payload); i += 4096 {
+			end := i + 4096
+			if end > len(payload) {
+				end = len(payload)
+			}
+			writer.Write(payload[i:end])
+		}
+		writer.Close()
+	}()
+	req, _ := http.NewRequest("POST", server.URL+"/files", reader)
+	req.Header.Set("S-Name", "artifact")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Id") != "1" {
+		t.Fatal("Bad push", res.Status, res.Header)
+	}
+	read := func(method, path string) []byte {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || res.Header.Get("S-Name") != "artifact" {
+			t.Fatal("Bad response", method, path, res.Status, res.Header)
+		}
+		return data
+	}
+	for _, c := range []struct{ method, path string }{{"GET", "/files"}, {"GET", "/_at/1/files"}, {"DELETE", "/files"}} {
+		if data := read(c.method, c.path); !bytes.Equal(data, payload) {
+			t.Fatal("Bad body", c.method, c.path, len(data))
+		}
+	}
+	if stack, _ := db.Find("files", false); stack == nil || stack.Depth() != 0 {
+		t.Fatal("Message is not popped")
+	}
+}
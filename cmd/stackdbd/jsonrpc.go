@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+
+	"github.com/reddec/file-stack-db/api"
+)
+
+// Standard error codes of JSON-RPC 2.0
+const (
+	jsonParseError     = -32700
+	jsonInvalidRequest = -32600
+	jsonMethodNotFound = -32601
+	jsonInvalidParams  = -32602
+	jsonServerError    = -32000
+)
+
+type jsonRequest struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  *json.RawMessage `json:"params"`
+	ID      *json.RawMessage `json:"id"`
+}
+
+type jsonError struct {
+	Code    int            `json:"code"`
+	Message string         `json:"message"`
+	Data    *jsonErrorData `json:"data,omitempty"`
+}
+
+// Details of database error
+type jsonErrorData struct {
+	Code api.Code `json:"code"`
+}
+
+type jsonResponse struct {
+	Version string           `json:"jsonrpc"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *jsonError       `json:"error,omitempty"`
+	ID      *json.RawMessage `json:"id"`
+}
+
+// Pending request of JSON-RPC connection
+type jsonCall struct {
+	id   *json.RawMessage // nil for notifications
+	code int              // error code of invalid request or params
+}
+
+// JSON-RPC 2.0 server codec for net/rpc. Methods are available with or without "db." prefix.
+// Parameters may be passed as value or as array with one value. Batch (array of requests) is served
+// in background by server of codec: responses of batch are written together as array
+type jsonServerCodec struct {
+	decoder *json.Decoder
+	encoder *json.Encoder
+	writer  *bufio.Writer
+	closer  io.Closer
+	request jsonRequest
+	server  *rpc.Server // Server of batches (nil - batches are invalid requests)
+
+	lock      sync.Mutex
+	seq       uint64
+	pending   map[uint64]*jsonCall
+	writeLock sync.Mutex
+}
+
+func newJSONServerCodec(conn io.ReadWriteCloser, server *rpc.Server) *jsonServerCodec {
+	writer := bufio.NewWriter(conn)
+	return &jsonServerCodec{
+		decoder: json.NewDecoder(conn),
+		encoder: json.NewEncoder(writer),
+		writer:  writer,
+		closer:  conn,
+		server:  server,
+		pending: make(map[uint64]*jsonCall),
+	}
+}
+
+func (c *jsonServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	var raw json.RawMessage
+	for {
+		// Batch keeps its buffer while it is served
+		raw = nil
+		if err := c.decoder.Decode(&raw); err != nil {
+			if err != io.EOF {
+				c.writeError(nil, jsonParseError, "Parse error: "+err.Error())
+			}
+			return err
+		}
+		if !isJSONBatch(raw) || c.server == nil {
+			break
+		}
+		go func(batch json.RawMessage) {
+			if responses := serveJSONBatch(c.server, batch); responses != nil {
+				c.write(responses)
+			}
+		}(raw)
+	}
+	// Value which is not request object is invalid request
+	c.request = jsonRequest{}
+	if json.Unmarshal(raw, &c.request) != nil {
+		c.request = jsonRequest{}
+	}
+	call := &jsonCall{id: c.request.ID}
+	r.ServiceMethod = c.request.Method
+	if c.request.Version != "2.0" || c.request.Method == "" {
+		// Ill-formed method name is rejected by server without closing connection
+		call.code = jsonInvalidRequest
+		r.ServiceMethod = ""
+	} else if !strings.Contains(r.ServiceMethod, ".") {
+		r.ServiceMethod = "db." + r.ServiceMethod
+	}
+	c.lock.Lock()
+	c.seq++
+	c.pending[c.seq] = call
+	r.Seq = c.seq
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *jsonServerCodec) ReadRequestBody(x interface{}) error {
+	if x == nil || c.request.Params == nil {
+		return nil
+	}
+	params := []byte(*c.request.Params)
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(params), []byte("[")) {
+		var values []json.RawMessage
+		if err = json.Unmarshal(params, &values); err == nil && len(values) == 1 {
+			params = values[0]
+		}
+	}
+	if err == nil {
+		err = json.Unmarshal(params, x)
+	}
+	if err != nil {
+		c.lock.Lock()
+		c.pending[c.seq].code = jsonInvalidParams
+		c.lock.Unlock()
+	}
+	return err
+}
+
+func (c *jsonServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.lock.Lock()
+	call, ok := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.lock.Unlock()
+	if !ok {
+		return errors.New("jsonrpc: unknown request sequence")
+	}
+	switch {
+	case call.code == jsonInvalidRequest:
+		return c.writeError(call.id, jsonInvalidRequest, "Invalid Request")
+	case call.id == nil:
+		// Notification: no response
+		return nil
+	case r.Error == "":
+		return c.write(jsonResponse{Version: "2.0", Result: x, ID: call.id})
+	case call.code != 0:
+		return c.writeError(call.id, call.code, r.Error)
+	case strings.HasPrefix(r.Error, "rpc: can't find"):
+		return c.writeError(call.id, jsonMethodNotFound, r.Error)
+	}
+	return c.write(jsonResponse{Version: "2.0", ID: call.id, Error: &jsonError{Code: jsonServerError, Message: r.Error,
+		Data: &jsonErrorData{Code: api.ErrorCode(rpc.ServerError(r.Error))}}})
+}
+
+func (c *jsonServerCodec) writeError(id *json.RawMessage, code int, message string) error {
+	return c.write(jsonErrorResponse(id, code, message))
+}
+
+func jsonErrorResponse(id *json.RawMessage, code int, message string) jsonResponse {
+	if id == nil {
+		null := json.RawMessage("null")
+		id = &null
+	}
+	return jsonResponse{Version: "2.0", Error: &jsonError{Code: code, Message: message}, ID: id}
+}
+
+// Write response or array of responses
+func (c *jsonServerCodec) write(response interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.encoder.Encode(response); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *jsonServerCodec) Close() error {
+	return c.closer.Close()
+}
+
+// Check that JSON value is array (batch of requests)
+func isJSONBatch(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '['
+}
+
+// Serve requests of batch concurrently. Returns array of responses in order of requests, error response for
+// empty or not parsed batch or nil if batch has only notifications
+func serveJSONBatch(server *rpc.Server, batch []byte) interface{} {
+	var requests []json.RawMessage
+	if err := json.Unmarshal(batch, &requests); err != nil {
+		return jsonErrorResponse(nil, jsonParseError, "Parse error: "+err.Error())
+	}
+	if len(requests) == 0 {
+		return jsonErrorResponse(nil, jsonInvalidRequest, "Invalid Request")
+	}
+	conns := make([]*jsonHTTPConn, len(requests))
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		conns[i] = &jsonHTTPConn{body: bytes.NewReader(request)}
+		wg.Add(1)
+		go func(conn *jsonHTTPConn) {
+			defer wg.Done()
+			// Nested batch is invalid request
+			server.ServeRequest(newJSONServerCodec(conn, nil))
+		}(conns[i])
+	}
+	wg.Wait()
+	var responses []json.RawMessage
+	for _, conn := range conns {
+		if response := bytes.TrimSpace(conn.response.Bytes()); len(response) > 0 {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+// Serve JSON-RPC 2.0 over TCP: requests and responses are JSON objects in stream. Each connection has own session
+func serveJSONRPC(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			s, err := connSession(conn)
+			if err != nil {
+				log.Println("[JSON-RPC] Failed accept connection from", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			server := newRPCServer(s)
+			server.ServeCodec(newJSONServerCodec(conn, server))
+		}()
+	}
+}
+
+// HTTP request body and response buffer as connection of codec
+type jsonHTTPConn struct {
+	body     io.Reader
+	response bytes.Buffer
+}
+
+func (conn *jsonHTTPConn) Read(p []byte) (int, error)  { return conn.body.Read(p) }
+func (conn *jsonHTTPConn) Write(p []byte) (int, error) { return conn.response.Write(p) }
+func (conn *jsonHTTPConn) Close() error                { return nil }
+
+// JSON-RPC 2.0 over HTTP: one request or batch per POST, notifications are answered by 204 No Content.
+// Session is authenticated by Authorization header of request
+func jsonRPCHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "JSON-RPC requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		s, err := newSession(r.Header.Get("Authorization"), r.TLS)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", auth.challenge())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		server := newRPCServer(s)
+		conn := &jsonHTTPConn{body: bytes.NewReader(body)}
+		codec := newJSONServerCodec(conn, nil)
+		if isJSONBatch(body) {
+			if responses := serveJSONBatch(server, body); responses != nil {
+				codec.write(responses)
+			}
+		} else if err := server.ServeRequest(codec); err == io.EOF {
+			codec.writeError(nil, jsonParseError, "Parse error: empty request")
+		}
+		if conn.response.Len() == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(conn.response.Bytes())
+	}
+}
+
+func enableJSONRPC(endpoint string) {
+	l := listen(endpoint)
+	panic(serveJSONRPC(l))
+}
+
+func enableJSONRPCHTTP(endpoint string) {
+	l := listen(endpoint)
+	panic(http.Serve(l, jsonRPCHandler()))
+}
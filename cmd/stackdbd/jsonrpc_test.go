@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+)
+
+type jsonTestResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *jsonError      `json:"error"`
+	ID      interface{}     `json:"id"`
+}
+
+func TestJSONRPC(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/jsonrpcdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+
+	// Raw TCP
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveJSONRPC(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	call := func(request string) jsonTestResponse {
+		if _, err := conn.Write([]byte(request + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		var response jsonTestResponse
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Version != "2.0" {
+			t.Fatal("Bad version", response.Version)
+		}
+		return response
+	}
+
+	res := call(`{"jsonrpc":"2.0","method":"db.Push","params":{"Section":"test","Headers":{"Name":"Alex"},"Body":"SGVsbG8gd29ybGQ="},"id":1}`)
+	var pushed int
+	if res.Error != nil || json.Unmarshal(res.Result, &pushed) != nil || pushed != 1 || res.ID != float64(1) {
+		t.Fatal("Bad push", res, res.Error)
+	}
+	res = call(`{"jsonrpc":"2.0","method":"Sections","params":["te"],"id":"s"}`)
+	var sections []api.Section
+	if res.Error != nil || json.Unmarshal(res.Result, &sections) != nil || len(sections) != 1 || sections[0].Name != "test" || res.ID != "s" {
+		t.Fatal("Bad sections", res, res.Error)
+	}
+	res = call(`{"jsonrpc":"2.0","method":"db.Peak","params":"test","id":2}`)
+	var data api.DataResult
+	if res.Error != nil || json.Unmarshal(res.Result, &data) != nil || string(data.Body) != "Hello world" || data.Headers["Name"] != "Alex" {
+		t.Fatal("Bad peak", res, res.Error)
+	}
+	res = call(`{"jsonrpc":"2.0","method":"db.Pop","params":"test","id":3}`)
+	if res.Error != nil || json.Unmarshal(res.Result, &data) != nil || string(data.Body) != "Hello world" || data.DepthIndex != 1 {
+		t.Fatal("Bad pop", res, res.Error)
+	}
+	for request, code := range map[string]int{
+		`{"jsonrpc":"2.0","method":"db.Pop","params":"test","id":4}`:        jsonServerError,
+		`{"jsonrpc":"2.0","method":"db.Unknown","params":"test","id":5}`:    jsonMethodNotFound,
+		`{"jsonrpc":"2.0","method":"db.Pop","params":{"Section":1},"id":6}`: jsonInvalidParams,
+		`{"jsonrpc":"1.0","method":"db.Pop","params":"test","id":7}`:        jsonInvalidRequest,
+	} {
+		res = call(request)
+		if res.Error == nil || res.Error.Code != code {
+			t.Fatal("Expected error", code, "for", request, "got", res.Error)
+		}
+	}
+	res = call(`{"jsonrpc":"2.0","method":"db.Pop","params":"test","id":8}`)
+	if res.Error.Message != api.ErrStackIsEmpty.Error() || res.Error.Data == nil || res.Error.Data.Code != api.CodeEmpty {
+		t.Fatal("Bad error", res.Error)
+	}
+
+	// HTTP
+	httpServer := httptest.NewServer(jsonRPCHandler())
+	defer httpServer.Close()
+	post := func(request string) *http.Response {
+		response, err := http.Post(httpServer.URL+"/rpc", "application/json", bytes.NewBufferString(request))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	postCall := func(request string) jsonTestResponse {
+		response := post(request)
+		defer response.Body.Close()
+		var res jsonTestResponse
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if res = postCall(`{"jsonrpc":"2.0","method":"Push","params":[{"Section":"test","Body":"AAE="}],"id":1}`); res.Error != nil {
+		t.Fatal("Bad HTTP push", res.Error)
+	}
+	res = postCall(`{"jsonrpc":"2.0","method":"db.Peak","params":"test","id":2}`)
+	if res.Error != nil || json.Unmarshal(res.Result, &data) != nil || !bytes.Equal(data.Body, []byte{0, 1}) {
+		t.Fatal("Bad HTTP peak", res.Error)
+	}
+	// Notification
+	response := post(`{"jsonrpc":"2.0","method":"db.Pop","params":"test"}`)
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatal("Notification must not have response", response.Status)
+	}
+	if s, err := db.Find("test", false); err != nil || s.Depth() != 0 {
+		t.Fatal("Notification is not processed")
+	}
+	if res = postCall(`{"jsonrpc":`); res.Error == nil || res.Error.Code != jsonParseError {
+		t.Fatal("Parse error expected", res.Error)
+	}
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/jsonrpcbatchdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+
+	batch := `[
+		{"jsonrpc":"2.0","method":"db.Push","params":{"Section":"batch","Body":"AAE="},"id":1},
+		{"jsonrpc":"2.0","method":"db.Push","params":{"Section":"batch","Body":"AAE="}},
+		{"jsonrpc":"2.0","method":"db.Unknown","params":"batch","id":2},
+		[{"jsonrpc":"2.0","method":"db.Peak","params":"batch","id":3}]
+	]`
+	checkBatch := func(responses []jsonTestResponse) {
+		if len(responses) != 3 {
+			t.Fatal("Response per request expected except notification:", responses)
+		}
+		codes := map[interface{}]int{}
+		for _, res := range responses {
+			if res.Version != "2.0" {
+				t.Fatal("Bad version", res.Version)
+			}
+			if res.Error != nil {
+				codes[res.ID] = res.Error.Code
+			}
+		}
+		if _, failed := codes[float64(1)]; failed || codes[float64(2)] != jsonMethodNotFound || codes[nil] != jsonInvalidRequest {
+			t.Fatal("Bad responses of batch", codes)
+		}
+	}
+
+	// Raw TCP: batch and single request on the same connection
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveJSONRPC(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(batch + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	var responses []jsonTestResponse
+	if err = json.NewDecoder(conn).Decode(&responses); err != nil {
+		t.Fatal(err)
+	}
+	checkBatch(responses)
+	if s, err := db.Find("batch", false); err != nil || s == nil || s.Depth() != 2 {
+		t.Fatal("Batch is not processed")
+	}
+
+	// HTTP
+	httpServer := httptest.NewServer(jsonRPCHandler())
+	defer httpServer.Close()
+	post := func(request string) *http.Response {
+		response, err := http.Post(httpServer.URL+"/rpc", "application/json", bytes.NewBufferString(request))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	response := post(batch)
+	err = json.NewDecoder(response.Body).Decode(&responses)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBatch(responses)
+	// Batch of notifications has no response
+	response = post(`[{"jsonrpc":"2.0","method":"db.Pop","params":"batch"},{"jsonrpc":"2.0","method":"db.Pop","params":"batch"}]`)
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatal("Batch of notifications must not have response", response.Status)
+	}
+	// Empty batch is single invalid request
+	response = post(`[]`)
+	var res jsonTestResponse
+	err = json.NewDecoder(response.Body).Decode(&res)
+	response.Body.Close()
+	if err != nil || res.Error == nil || res.Error.Code != jsonInvalidRequest {
+		t.Fatal("Invalid request expected for empty batch", res.Error, err)
+	}
+}
@@ -16,21 +16,77 @@ func main() {
 	http := flag.String("http", "", "HTTP API endpoint")
 	rpc := flag.String("rpc", "", "GO-RPC (gob) endpoint")
 	rpcHTTP := flag.String("http-rpc", "", "GO HTTP RPC endpoint. Default prefix will be used")
+	jsonRPC := flag.String("json-rpc", "", "JSON-RPC 2.0 endpoint over TCP")
+	jsonRPCHTTP := flag.String("http-json-rpc", "", "JSON-RPC 2.0 endpoint over HTTP (POST to any path)")
+	grpc := flag.String("grpc", "", "gRPC endpoint (see api/pb/stackdb.proto)")
+	resp := flag.String("resp", "", "Redis protocol (RESP) endpoint. Stacks are available as lists")
 	rootPath := flag.String("root", "./db", "Root dir for stacked database")
 	keepAlive := flag.Duration("keep-alive", 10*time.Second, "Opened file keep-alive timeout")
+	maxOpenFiles := flag.Int("max-open-files", 0, "Maximum number of opened stack files, including indexes (0 - unlimited)")
+	retentionInterval := flag.Duration("retention-interval", time.Minute, "Interval of retention policies applying (0 - disabled)")
+	retention := retentionFlags{}
+	flag.Var(retention, "retain", "Retention policy of section in format section=depth:N,bytes:N,age:D (may be repeated)")
+	syncMode := flag.String("sync", "none", "Durability of pushed messages: none, always (fsync before response) or interval (group commit)")
+	syncInterval := flag.Duration("sync-interval", 100*time.Millisecond, "Interval of group commit for -sync interval")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate (PEM) of all listeners. Certificates are reloaded by SIGHUP")
+	tlsKey := flag.String("tls-key", "", "TLS private key (PEM) of certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA certificates (PEM) of clients. Verified client certificate is required if set")
+	authTokens := flag.String("auth-tokens", "", "File of bearer tokens (user:token per line). Enables authentication")
+	authHtpasswd := flag.String("auth-htpasswd", "", "Htpasswd file of users (bcrypt or SHA1 hashes). Enables authentication")
+	authCerts := flag.Bool("auth-certs", false, "Authenticate users by common name of verified TLS client certificate (see -tls-client-ca)")
+	acl := flag.String("acl", "", "ACL file: rights (read, push, pop, all) of user per section prefix. All rights are granted without ACL")
+	headerPrefix := flag.String("header-prefix", "S-", "Prefix of HTTP headers saved with message (without prefix). Empty - prefixed headers are not saved")
+	headerAllow := flag.String("header-allow", "", "Comma-separated HTTP headers saved with message as is. Content-Type is always saved")
+	flag.Var(sectionCodecs, "header-codec", "Codec of message headers of new stacks in section: section=json|msgpack|multi|raw (may be repeated, empty section - all)")
+	verify := flag.Bool("verify", false, "Verify checksums of all messages during scan")
 	silent := flag.Bool("silent", false, "Discard log output")
 	flag.Parse()
 	if *silent {
 		log.SetOutput(ioutil.Discard)
 	}
-	fsdb, err := fstack.NewDatabase(*rootPath, *keepAlive)
+	durability, err := fstack.ParseSyncMode(*syncMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *authCerts && *tlsClientCA == "" {
+		log.Fatal("authentication by client certificates requires -tls-client-ca")
+	}
+	serverTLS, err = newTLSFiles(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if serverTLS != nil {
+		go reloadTLSOnSignal(serverTLS)
+	}
+	headerMap = newHeaderMapping(*headerPrefix, *headerAllow)
+	auth, err = newAuthConfig(*authTokens, *authHtpasswd, *authCerts, *acl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fsdb, err := fstack.NewDatabase(*rootPath, *keepAlive,
+		fstack.MaxOpenFiles(*maxOpenFiles),
+		fstack.RetentionInterval(*retentionInterval),
+		fstack.Durability(durability, *syncInterval))
 	if err != nil {
 		panic(err)
 	}
 	db = fsdb
+	for section, policy := range retention {
+		log.Println("Retention policy of section", section, "-", formatRetention(policy))
+		db.SetRetention(section, policy)
+	}
 	defer db.Close()
 	log.Println("Scaning saved stacks")
-	err = db.Scan()
+	if *verify {
+		var bad []fstack.BadBlock
+		bad, err = db.ScanVerify()
+		for _, block := range bad {
+			log.Println("Corrupted", block.Part, "of message", block.Depth, "in stack", block.Key, "at", block.Offset)
+		}
+		log.Println("Verification done:", len(bad), "bad blocks")
+	} else {
+		err = db.Scan()
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -57,5 +113,33 @@ func main() {
 			enableRPCHTTP(*rpcHTTP)
 		}()
 	}
+	if *jsonRPC != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enableJSONRPC(*jsonRPC)
+		}()
+	}
+	if *jsonRPCHTTP != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enableJSONRPCHTTP(*jsonRPCHTTP)
+		}()
+	}
+	if *grpc != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enableGRPC(*grpc)
+		}()
+	}
+	if *resp != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enableRESP(*resp)
+		}()
+	}
 	wg.Wait()
 }
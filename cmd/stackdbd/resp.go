@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+)
+
+// Limits of RESP requests. Connections which have to authenticate are limited by anonymous limits until AUTH
+const (
+	maxRESPArgs              = 1024 * 1024
+	maxRESPBulkSize          = 512 * 1024 * 1024
+	maxRESPAnonymousArgs     = 16
+	maxRESPAnonymousBulkSize = 64 * 1024
+	maxRESPInlineSize        = 64 * 1024
+)
+
+// Number of arguments allocated before arguments are read
+const respArgsPrealloc = 64
+
+// Default number of keys in SCAN reply
+const defaultScanCount = 10
+
+var errRESPProtocol = errors.New("ERR Protocol error")
+
+// Client connection of RESP (Redis protocol) listener. Head of Redis list (index 0) is last pushed message
+type respConn struct {
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	session *session
+}
+
+// Reply which is written as is
+type respStatus string
+
+// Reply of error
+type respError string
+
+type respCommand func(args [][]byte) interface{}
+
+func enableRESP(endpoint string) {
+	l := listen(endpoint)
+	panic(serveRESP(l))
+}
+
+func serveRESP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handleRESP(conn)
+	}
+}
+
+func handleRESP(conn net.Conn) {
+	defer conn.Close()
+	s, err := connSession(conn)
+	if err != nil {
+		log.Println("[RESP] Failed accept connection from", conn.RemoteAddr(), err)
+		return
+	}
+	rc := &respConn{reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn), session: s}
+	for {
+		args, err := rc.readCommand()
+		if err == errRESPProtocol {
+			rc.writeReply(respError(err.Error()))
+			rc.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(string(args[0]))
+		if name == "QUIT" {
+			rc.writeReply(respStatus("OK"))
+			rc.writer.Flush()
+			return
+		}
+		command, ok := respCommands[name]
+		if name == "AUTH" {
+			rc.writeReply(rc.auth(args[1:]))
+		} else if !ok {
+			rc.writeReply(respError("ERR unknown command '" + string(args[0]) + "'"))
+		} else if denied := rc.check(name, args[1:]); denied != "" {
+			rc.writeReply(denied)
+		} else {
+			rc.writeReply(command(args[1:]))
+		}
+		// Pipelined commands are replied together
+		if rc.reader.Buffered() == 0 {
+			if err = rc.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read command as array of bulk strings or inline command
+func (rc *respConn) readCommand() ([][]byte, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, field := range strings.Fields(line) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+	maxArgs, maxBulkSize := rc.limits()
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxArgs {
+		return nil, errRESPProtocol
+	}
+	// Buffers grow as data arrives: sizes in request are not trusted
+	args := make([][]byte, 0, minInt(count, respArgsPrealloc))
+	for i := 0; i < count; i++ {
+		line, err = rc.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, errRESPProtocol
+		}
+		var arg bytes.Buffer
+		if _, err = io.CopyN(&arg, rc.reader, int64(size)+2); err != nil {
+			return nil, err
+		}
+		args = append(args, arg.Bytes()[:size])
+	}
+	return args, nil
+}
+
+// Limits of arguments count and size of bulk string for connection
+func (rc *respConn) limits() (int, int) {
+	if auth.required() {
+		if _, authenticated := rc.session.identity(); !authenticated {
+			return maxRESPAnonymousArgs, maxRESPAnonymousBulkSize
+		}
+	}
+	return maxRESPArgs, maxRESPBulkSize
+}
+
+// Read line up to maxRESPInlineSize bytes
+func (rc *respConn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := rc.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+		if len(line) > maxRESPInlineSize {
+			return "", errRESPProtocol
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Write reply by type: status, error, integer, bulk string (nil - null bulk string) or array
+func (rc *respConn) writeReply(reply interface{}) {
+	switch v := reply.(type) {
+	case respStatus:
+		rc.writer.WriteString("+" + string(v) + "\r\n")
+	case respError:
+		rc.writer.WriteString("-" + string(v) + "\r\n")
+	case int:
+		rc.writer.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case []byte:
+		if v == nil {
+			rc.writer.WriteString("$-1\r\n")
+			return
+		}
+		rc.writer.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+		rc.writer.Write(v)
+		rc.writer.WriteString("\r\n")
+	case string:
+		rc.writeReply([]byte(v))
+	case []interface{}:
+		rc.writer.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			rc.writeReply(item)
+		}
+	default:
+		rc.writer.WriteString("*-1\r\n")
+	}
+}
+
+var respCommands map[string]respCommand
+
+func init() {
+	respCommands = map[string]respCommand{
+		"PING":    respPing,
+		"ECHO":    respEcho,
+		"SELECT":  func(args [][]byte) interface{} { return respStatus("OK") },
+		"COMMAND": func(args [][]byte) interface{} { return []interface{}{} },
+		"LPUSH":   respLPush,
+		"RPUSH":   respRPush,
+		"LPOP":    func(args [][]byte) interface{} { return respPop(args, db.Pop) },
+		"RPOP":    func(args [][]byte) interface{} { return respPop(args, db.Shift) },
+		"LINDEX":  respLIndex,
+		"LRANGE":  respLRange,
+		"LLEN":    respLLen,
+		"DEL":     respDel,
+		"KEYS":    respKeys,
+		"SCAN":    respScan,
+	}
+}
+
+// Rights required by commands for keys: all arguments of DEL, first argument of other commands
+// and all stacks for KEYS and SCAN
+var respRights = map[string]right{
+	"LPUSH":  rightPush,
+	"RPUSH":  rightPush,
+	"LPOP":   rightPop,
+	"RPOP":   rightPop,
+	"LINDEX": rightRead,
+	"LRANGE": rightRead,
+	"LLEN":   rightRead,
+	"DEL":    rightPop,
+	"KEYS":   rightRead,
+	"SCAN":   rightRead,
+}
+
+// AUTH [username] password - authenticate connection by password of user or by token
+func (rc *respConn) auth(args [][]byte) interface{} {
+	var creds api.AuthArgs
+	switch len(args) {
+	case 1:
+		creds.Token = string(args[0])
+	case 2:
+		creds.User, creds.Password = string(args[0]), string(args[1])
+	default:
+		return wrongArgs("auth")
+	}
+	if auth == nil {
+		return respError("ERR AUTH called without any authentication configured")
+	}
+	if rc.session.login(creds) != nil {
+		return respError("WRONGPASS invalid username-password pair or token")
+	}
+	return respStatus("OK")
+}
+
+// Check rights of connection for command. Empty reply means allowed command
+func (rc *respConn) check(name string, args [][]byte) respError {
+	r, ok := respRights[name]
+	if !ok && auth.required() {
+		// Service commands (PING, ECHO...) are available after authentication only
+		if _, authenticated := rc.session.identity(); !authenticated {
+			return respError("NOAUTH Authentication required")
+		}
+	}
+	if !ok || len(args) == 0 {
+		return ""
+	}
+	keys := args[:1]
+	switch name {
+	case "DEL":
+		keys = args
+	case "KEYS", "SCAN":
+		keys = [][]byte{nil}
+	}
+	for _, key := range keys {
+		switch rc.session.check(string(key), r) {
+		case api.ErrUnauthorized:
+			return respError("NOAUTH Authentication required")
+		case api.ErrAccessDenied:
+			if key == nil {
+				return respError("NOPERM no permissions to access all stacks")
+			}
+			return respError("NOPERM no permissions to access '" + string(key) + "' stack")
+		}
+	}
+	return ""
+}
+
+func wrongArgs(command string) respError {
+	return respError("ERR wrong number of arguments for '" + command + "' command")
+}
+
+// Convert database error to RESP error
+func respDBError(err error) respError {
+	return respError("ERR " + err.Error())
+}
+
+func respPing(args [][]byte) interface{} {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return respStatus("PONG")
+}
+
+func respEcho(args [][]byte) interface{} {
+	if len(args) != 1 {
+		return wrongArgs("echo")
+	}
+	return args[0]
+}
+
+// LPUSH key value [value ...] - push values to stack. Last value becomes head of list
+func respLPush(args [][]byte) interface{} {
+	if len(args) < 2 {
+		return wrongArgs("lpush")
+	}
+	log.Println("[RESP] LPUSH to", string(args[0]), len(args)-1, "values")
+	headers, err := encodeHeaders(string(args[0]), nil)
+	if err != nil {
+		return respDBError(err)
+	}
+	if len(args) == 2 {
+		depth, err := db.Push(string(args[0]), headers, args[1])
+		if err != nil {
+			return respDBError(err)
+		}
+		return depth
+	}
+	// Values are pushed atomically
+	messages := make([]fstack.Message, len(args)-1)
+	for i, value := range args[1:] {
+		messages[i] = fstack.Message{Key: string(args[0]), Header: headers, Data: value}
+	}
+	depths, err := db.PushBatch(messages)
+	if err != nil {
+		return respDBError(err)
+	}
+	return depths[len(depths)-1]
+}
+
+// RPUSH key value [value ...] - insert values before first message of stack. Stack file is rewritten for each value
+func respRPush(args [][]byte) interface{} {
+	if len(args) < 2 {
+		return wrongArgs("rpush")
+	}
+	log.Println("[RESP] RPUSH to", string(args[0]), len(args)-1, "values")
+	headers, err := encodeHeaders(string(args[0]), nil)
+	if err != nil {
+		return respDBError(err)
+	}
+	var depth int
+	for _, value := range args[1:] {
+		depth, err = db.Unshift(string(args[0]), headers, value)
+		if err != nil {
+			return respDBError(err)
+		}
+	}
+	return depth
+}
+
+// LPOP/RPOP key [count] - remove and return head (last message) or tail (first message) of list
+func respPop(args [][]byte, pop func(key string) (fstack.Segment, error)) interface{} {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs("pop")
+	}
+	count := 1
+	if len(args) == 2 {
+		var err error
+		if count, err = strconv.Atoi(string(args[1])); err != nil || count < 0 {
+			return respError("ERR value is out of range, must be positive")
+		}
+	}
+	var values []interface{}
+	for i := 0; i < count; i++ {
+		segment, err := pop(string(args[0]))
+		if err == fstack.ErrNotFound || err == fstack.ErrEmpty {
+			break
+		}
+		if err != nil {
+			return respDBError(err)
+		}
+		values = append(values, segment.Data)
+	}
+	if len(args) == 1 {
+		if len(values) == 0 {
+			return []byte(nil)
+		}
+		return values[0]
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// Depth of stack or 0 if stack not exists
+func stackDepth(key string) (int, error) {
+	s, err := db.Find(key, false)
+	if err != nil || s == nil {
+		return 0, err
+	}
+	return s.Depth(), nil
+}
+
+// Convert Redis list index (0 - head, -1 - tail) to depth index
+func listDepth(index, depth int) int {
+	if index < 0 {
+		index += depth
+	}
+	return depth - index
+}
+
+// LINDEX key index - get list element (0 - last pushed message)
+func respLIndex(args [][]byte) interface{} {
+	if len(args) != 2 {
+		return wrongArgs("lindex")
+	}
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return respError("ERR value is not an integer or out of range")
+	}
+	depth, err := stackDepth(string(args[0]))
+	if err != nil {
+		return respDBError(err)
+	}
+	_, data, err := db.At(string(args[0]), listDepth(index, depth))
+	if err == fstack.ErrNotFound || err == fstack.ErrOutOfRange {
+		return []byte(nil)
+	}
+	if err != nil {
+		return respDBError(err)
+	}
+	return data
+}
+
+// LRANGE key start stop - get list elements from head (last pushed message)
+func respLRange(args [][]byte) interface{} {
+	if len(args) != 3 {
+		return wrongArgs("lrange")
+	}
+	start, err1 := strconv.Atoi(string(args[1]))
+	stop, err2 := strconv.Atoi(string(args[2]))
+	if err1 != nil || err2 != nil {
+		return respError("ERR value is not an integer or out of range")
+	}
+	depth, err := stackDepth(string(args[0]))
+	if err != nil {
+		return respDBError(err)
+	}
+	if start < 0 {
+		start += depth
+	}
+	if stop < 0 {
+		stop += depth
+	}
+	if start < 0 {
+		start = 0
+	}
+	values := []interface{}{}
+	if start > stop || start >= depth {
+		return values
+	}
+	segments, err := db.Range(string(args[0]), depth-stop, depth-start)
+	if err != nil && err != fstack.ErrNotFound {
+		return respDBError(err)
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		values = append(values, segments[i].Data)
+	}
+	return values
+}
+
+// LLEN key - depth of stack
+func respLLen(args [][]byte) interface{} {
+	if len(args) != 1 {
+		return wrongArgs("llen")
+	}
+	depth, err := stackDepth(string(args[0]))
+	if err != nil {
+		return respDBError(err)
+	}
+	return depth
+}
+
+// DEL key [key ...] - remove stacks. Returns number of removed stacks
+func respDel(args [][]byte) interface{} {
+	if len(args) < 1 {
+		return wrongArgs("del")
+	}
+	removed := 0
+	for _, key := range args {
+		if s, err := db.Find(string(key), false); err != nil || s == nil {
+			continue
+		}
+		if err := db.Remove(string(key)); err != nil {
+			return respDBError(err)
+		}
+		log.Println("[RESP] DEL", string(key))
+		removed++
+	}
+	return removed
+}
+
+// Convert Redis glob pattern to regular expression
+func globPattern(glob string) (*regexp.Regexp, error) {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				pattern.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			pattern.WriteString("[" + strings.Replace(class, `\-`, "-", -1) + "]")
+			i += end
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.Compile(pattern.String())
+}
+
+// Sorted names of stacks matched to glob pattern
+func matchedNames(glob string) ([]string, error) {
+	pattern, err := globPattern(glob)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range db.Names() {
+		if pattern.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// KEYS pattern - names of stacks matched to pattern
+func respKeys(args [][]byte) interface{} {
+	if len(args) != 1 {
+		return wrongArgs("keys")
+	}
+	names, err := matchedNames(string(args[0]))
+	if err != nil {
+		return respError("ERR " + err.Error())
+	}
+	keys := []interface{}{}
+	for _, name := range names {
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] - iterate over stack names. Cursor is offset in sorted names,
+// pattern is applied to each portion of names as in Redis
+func respScan(args [][]byte) interface{} {
+	if len(args) < 1 || len(args)%2 != 1 {
+		return wrongArgs("scan")
+	}
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		return respError("ERR invalid cursor")
+	}
+	glob, count := "*", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			glob = string(args[i+1])
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				return respError("ERR value is out of range")
+			}
+		default:
+			return respError("ERR syntax error")
+		}
+	}
+	pattern, err := globPattern(glob)
+	if err != nil {
+		return respError("ERR " + err.Error())
+	}
+	names := db.Names()
+	sort.Strings(names)
+	keys := []interface{}{}
+	next := 0
+	if cursor < len(names) {
+		end := cursor + count
+		if end < len(names) {
+			next = end
+		} else {
+			end = len(names)
+		}
+		for _, name := range names[cursor:end] {
+			if pattern.MatchString(name) {
+				keys = append(keys, name)
+			}
+		}
+	}
+	return []interface{}{fmt.Sprint(next), keys}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+)
+
+// Minimal RESP client: sends command as array of bulk strings and reads reply
+type respClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (rc *respClient) do(t *testing.T, args ...string) interface{} {
+	request := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		request += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := io.WriteString(rc.conn, request); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := rc.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// Read reply: status and bulk strings as string, errors as error, integers as int, arrays as []interface{}
+func (rc *respClient) read() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(rc.reader, data)
+		return string(data[:size]), err
+	case '*':
+		count, _ := strconv.Atoi(line[1:])
+		if count < 0 {
+			return nil, nil
+		}
+		items := []interface{}{}
+		for i := 0; i < count; i++ {
+			item, err := rc.read()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, errRESPProtocol
+}
+
+func TestRESP(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/respdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveRESP(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &respClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	check := func(expected interface{}, args ...string) {
+		if reply := client.do(t, args...); !reflect.DeepEqual(reply, expected) {
+			t.Fatalf("%v: expected %#v, got %#v", args, expected, reply)
+		}
+	}
+	check("PONG", "PING")
+	check(2, "LPUSH", "list", "a", "b")
+	check(3, "LPUSH", "list", "c")
+	check(4, "RPUSH", "list", "z")
+	check(4, "LLEN", "list")
+	check(0, "LLEN", "missing")
+	check("c", "LINDEX", "list", "0")
+	check("z", "LINDEX", "list", "-1")
+	check(nil, "LINDEX", "list", "10")
+	check([]interface{}{"c", "b", "a", "z"}, "LRANGE", "list", "0", "-1")
+	check([]interface{}{"b", "a"}, "LRANGE", "list", "1", "2")
+	check([]interface{}{}, "LRANGE", "list", "5", "10")
+	check("c", "LPOP", "list")
+	check("z", "RPOP", "list")
+	check([]interface{}{"b", "a"}, "LPOP", "list", "5")
+	check(nil, "LPOP", "list")
+
+	check(1, "LPUSH", "other", "x")
+	check(1, "LPUSH", "sensors/room1", "x")
+	check([]interface{}{"list", "other"}, "KEYS", "[lo]*")
+	check([]interface{}{"1", []interface{}{"list"}}, "SCAN", "0", "COUNT", "1")
+	check([]interface{}{"0", []interface{}{"sensors/room1"}}, "SCAN", "1", "MATCH", "s*", "COUNT", "10")
+	check(2, "DEL", "other", "sensors/room1", "missing")
+	check([]interface{}{"list"}, "KEYS", "*")
+	if _, ok := client.do(t, "UNKNOWN").(respError); !ok {
+		t.Fatal("Error expected for unknown command")
+	}
+	// Inline command
+	if _, err = io.WriteString(conn, "PING hello\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := client.read(); err != nil || reply != "hello" {
+		t.Fatal("Bad inline reply", reply, err)
+	}
+}
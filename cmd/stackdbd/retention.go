@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+)
+
+// Retention policies from command line: section=depth:100,bytes:1048576,age:24h
+type retentionFlags map[string]fstack.Retention
+
+func (rf retentionFlags) String() string {
+	var items []string
+	for section, policy := range rf {
+		items = append(items, section+"="+formatRetention(policy))
+	}
+	return strings.Join(items, " ")
+}
+
+func (rf retentionFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return errors.New("retention policy must be in format section=depth:N,bytes:N,age:D")
+	}
+	policy, err := parseRetention(parts[1])
+	if err != nil {
+		return err
+	}
+	rf[parts[0]] = policy
+	return nil
+}
+
+func parseRetention(value string) (fstack.Retention, error) {
+	var policy fstack.Retention
+	for _, limit := range strings.Split(value, ",") {
+		kv := strings.SplitN(limit, ":", 2)
+		if len(kv) != 2 {
+			return policy, errors.New("bad retention limit " + limit)
+		}
+		var err error
+		switch kv[0] {
+		case "depth":
+			policy.MaxDepth, err = strconv.Atoi(kv[1])
+		case "bytes":
+			policy.MaxBytes, err = strconv.ParseInt(kv[1], 10, 64)
+		case "age":
+			policy.MaxAge, err = time.ParseDuration(kv[1])
+		default:
+			err = errors.New("unknown retention limit " + kv[0])
+		}
+		if err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+func formatRetention(policy fstack.Retention) string {
+	var limits []string
+	if policy.MaxDepth > 0 {
+		limits = append(limits, "depth:"+strconv.Itoa(policy.MaxDepth))
+	}
+	if policy.MaxBytes > 0 {
+		limits = append(limits, "bytes:"+strconv.FormatInt(policy.MaxBytes, 10))
+	}
+	if policy.MaxAge > 0 {
+		limits = append(limits, "age:"+policy.MaxAge.String())
+	}
+	return strings.Join(limits, ",")
+}
@@ -7,82 +7,267 @@ import (
 	"net/rpc"
 	"strings"
 
+	"github.com/reddec/file-stack-db"
 	"github.com/reddec/file-stack-db/api"
 )
 
 type Service struct {
 	api.Service
+	session *session // client identity, nil - anonymous
+}
+
+// Authenticate session of connection by token or user name and password
+func (srv *Service) Auth(args api.AuthArgs, ok *bool) error {
+	log.Println("[RPC] Auth", args.User)
+	if srv.session == nil {
+		return api.ErrUnauthorized
+	}
+	if err := srv.session.login(args); err != nil {
+		return err
+	}
+	*ok = true
+	return nil
 }
 
 func (srv *Service) Push(msg api.PushArgs, resultDepthIndex *int) error {
+	var result api.PushResult
+	if err := srv.PushSync(msg, &result); err != nil {
+		return err
+	}
+	*resultDepthIndex = result.DepthIndex
+	return nil
+}
+
+// PushSync - push message and report durability guarantee of pushed message
+func (srv *Service) PushSync(msg api.PushArgs, result *api.PushResult) error {
 	log.Println("[RPC] Push to", msg.Section, "headers:", len(msg.Headers), "items, body:", len(msg.Body), "bytes")
-	s, err := db.Find(msg.Section, true)
-	if err != nil {
+	if err := srv.session.check(msg.Section, rightPush); err != nil {
 		return err
 	}
-	binHeaders := encodeHeaders(msg.Headers)
-	id, err := s.Push(binHeaders, msg.Body)
+	binHeaders, err := encodeMessage(msg.Section, msg.Message)
 	if err != nil {
-		return err
+		return apiError(err)
+	}
+	id, err := db.Push(msg.Section, binHeaders, msg.Body)
+	if err != nil {
+		return apiError(err)
 	}
-	*resultDepthIndex = id
+	result.DepthIndex = id
+	result.Durability = db.SyncMode().String()
 	return nil
 }
 
-func (srv *Service) Peak(section string, result *api.DataResult) error {
-	log.Println("[RPC] Peak from", section)
-	s, err := db.Find(section, false)
+func (srv *Service) PushBatch(batch []api.PushArgs, result *[]api.PushResult) error {
+	log.Println("[RPC] Push batch of", len(batch), "messages")
+	for _, msg := range batch {
+		if err := srv.session.check(msg.Section, rightPush); err != nil {
+			return err
+		}
+	}
+	res, err := pushBatch(batch)
+	if err != nil {
+		return apiError(err)
+	}
+	*result = res
+	return nil
+}
+
+func (srv *Service) Transact(ops []api.TxOp, result *[]api.DataResult) error {
+	log.Println("[RPC] Transaction of", len(ops), "operations")
+	for _, op := range ops {
+		r := rightPush
+		if op.Pop {
+			r = rightPop
+		}
+		if err := srv.session.check(op.Section, r); err != nil {
+			return err
+		}
+	}
+	tx := db.Begin()
+	for _, op := range ops {
+		if op.Pop {
+			tx.Pop(op.Section)
+			continue
+		}
+		headers, err := encodeMessage(op.Section, op.Message)
+		if err != nil {
+			return apiError(err)
+		}
+		tx.Push(op.Section, headers, op.Body)
+	}
+	segments, err := tx.Commit()
 	if err != nil {
+		return apiError(err)
+	}
+	res := make([]api.DataResult, len(segments))
+	for i, segment := range segments {
+		res[i].DepthIndex = segment.Depth
+		if ops[i].Pop {
+			res[i].Message = decodeMessage(ops[i].Section, segment.Header, segment.Data)
+		}
+	}
+	*result = res
+	return nil
+}
+
+func (srv *Service) Move(args api.MoveArgs, result *api.DataResult) error {
+	log.Println("[RPC] Move from", args.Section, "to", args.To)
+	if err := srv.session.check(args.Section, rightPop); err != nil {
 		return err
 	}
-	if s == nil {
-		return api.ErrSectionNotFound
+	if err := srv.session.check(args.To, rightPush); err != nil {
+		return err
+	}
+	if err := checkMove(args.Section, args.To); err != nil {
+		return apiError(err)
 	}
-	dr := api.DataResult{}
-	dr.DepthIndex = s.Depth()
-	headers, body, err := s.Peak()
+	segment, err := db.Move(args.Section, args.To)
 	if err != nil {
+		return apiError(err)
+	}
+	*result = segmentResult(args.To, segment)
+	return nil
+}
+
+// Push batch of messages and make result for each message
+func pushBatch(batch []api.PushArgs) ([]api.PushResult, error) {
+	messages := make([]fstack.Message, len(batch))
+	for i, msg := range batch {
+		headers, err := encodeMessage(msg.Section, msg.Message)
+		if err != nil {
+			return nil, err
+		}
+		messages[i] = fstack.Message{Key: msg.Section, Header: headers, Data: msg.Body}
+	}
+	depths, err := db.PushBatch(messages)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]api.PushResult, len(depths))
+	for i, depth := range depths {
+		res[i].DepthIndex = depth
+		res[i].Durability = db.SyncMode().String()
+	}
+	return res, nil
+}
+
+func (srv *Service) Peak(section string, result *api.DataResult) error {
+	log.Println("[RPC] Peak from", section)
+	if err := srv.session.check(section, rightRead); err != nil {
 		return err
 	}
-	if headers == nil || body == nil {
-		return api.ErrStackIsEmpty
+	segment, err := db.Peak(section)
+	if err != nil {
+		return apiError(err)
 	}
-	dr.Headers = decodeHeaders(headers)
-	dr.Body = body
-	*result = dr
+	*result = segmentResult(section, segment)
 	return nil
 }
 
 func (srv *Service) Pop(section string, result *api.DataResult) error {
 	log.Println("[RPC] Pop from", section)
-	s, err := db.Find(section, false)
-	if err != nil {
+	if err := srv.session.check(section, rightPop); err != nil {
 		return err
 	}
-	if s == nil {
-		return api.ErrSectionNotFound
+	segment, err := db.Pop(section)
+	if err != nil {
+		return apiError(err)
 	}
-	dr := api.DataResult{}
-	dr.DepthIndex = s.Depth()
-	headers, body, err := s.Pop()
+	*result = segmentResult(section, segment)
+	return nil
+}
+
+func (srv *Service) PopWait(args api.PopWaitArgs, result *api.DataResult) error {
+	log.Println("[RPC] Pop from", args.Section, "with wait", args.Timeout)
+	if err := srv.session.check(args.Section, rightPop); err != nil {
+		return err
+	}
+	segment, err := db.PopWait(args.Section, args.Timeout)
 	if err != nil {
+		return apiError(err)
+	}
+	*result = segmentResult(args.Section, segment)
+	return nil
+}
+
+func (srv *Service) Get(args api.IndexArgs, result *api.DataResult) error {
+	log.Println("[RPC] Get from", args.Section, "at", args.DepthIndex)
+	if err := srv.session.check(args.Section, rightRead); err != nil {
 		return err
 	}
-	if headers == nil || body == nil {
-		return api.ErrStackIsEmpty
+	headers, body, err := db.At(args.Section, args.DepthIndex)
+	if err != nil {
+		return apiError(err)
 	}
-	dr.Headers = decodeHeaders(headers)
-	dr.Body = body
+	dr := api.DataResult{Message: decodeMessage(args.Section, headers, body)}
+	dr.DepthIndex = args.DepthIndex
 	*result = dr
 	return nil
 }
 
+func (srv *Service) Range(args api.RangeArgs, result *[]api.DataResult) error {
+	log.Println("[RPC] Range from", args.Section, "from", args.From, "to", args.To)
+	if err := srv.session.check(args.Section, rightRead); err != nil {
+		return err
+	}
+	segments, err := db.Range(args.Section, args.From, args.To)
+	if err != nil {
+		return apiError(err)
+	}
+	*result = segmentsResult(args.Section, segments)
+	return nil
+}
+
+func (srv *Service) History(args api.HistoryArgs, result *[]api.DataResult) error {
+	log.Println("[RPC] History of", args.Section, "offset", args.Offset, "limit", args.Limit, "ascending", args.Ascending)
+	if err := srv.session.check(args.Section, rightRead); err != nil {
+		return err
+	}
+	segments, err := db.History(args.Section, args.Offset, args.Limit, args.Ascending)
+	if err != nil {
+		return apiError(err)
+	}
+	*result = segmentsResult(args.Section, segments)
+	return nil
+}
+
+func segmentResult(section string, segment fstack.Segment) api.DataResult {
+	dr := api.DataResult{Message: decodeMessage(section, segment.Header, segment.Data)}
+	dr.DepthIndex = segment.Depth
+	return dr
+}
+
+func segmentsResult(section string, segments []fstack.Segment) []api.DataResult {
+	res := []api.DataResult{}
+	for _, segment := range segments {
+		res = append(res, segmentResult(section, segment))
+	}
+	return res
+}
+
+// Convert database errors to common API errors
+func apiError(err error) error {
+	switch err {
+	case fstack.ErrNotFound:
+		return api.ErrSectionNotFound
+	case fstack.ErrEmpty:
+		return api.ErrStackIsEmpty
+	case fstack.ErrOutOfRange:
+		return api.ErrOutOfRange
+	case fstack.ErrCorrupted:
+		return api.ErrCorrupted
+	case fstack.ErrNotStack:
+		return api.ErrNotStack
+	}
+	return err
+}
+
 func (srv *Service) Sections(prefix string, result *[]api.Section) error {
 	log.Println("[RPC] Sections with prefix", prefix)
 	res := []api.Section{}
 	names := db.Names()
 	for _, name := range names {
-		if strings.HasPrefix(name, prefix) {
+		if strings.HasPrefix(name, prefix) && srv.session.check(name, rightRead) == nil {
 			var sec api.Section
 			s := db.Get(name)
 			sec.Depth = s.Depth()
@@ -95,24 +280,87 @@ func (srv *Service) Sections(prefix string, result *[]api.Section) error {
 	return nil
 }
 
-func enableRPC(endpoint string) {
-	srv := new(Service)
-	rpc.RegisterName("db", srv)
+// Direct children (stacks and sub-sections) of section. Child is listed if session can read any stack inside it
+func (srv *Service) Children(section string, result *[]string) error {
+	log.Println("[RPC] Children of", section)
+	if err := srv.session.check(section, 0); err != nil {
+		return err
+	}
+	readable := map[string]bool{}
+	for _, name := range db.Sub(section).Names() {
+		child := strings.SplitN(name, fstack.SectionSeparator, 2)[0]
+		if !readable[child] && srv.session.check(fstack.CleanKey(section+fstack.SectionSeparator+name), rightRead) == nil {
+			readable[child] = true
+		}
+	}
+	res := []string{}
+	for _, child := range db.Children(section) {
+		if readable[child] {
+			res = append(res, child)
+		}
+	}
+	*result = res
+	return nil
+}
 
-	l, e := net.Listen("tcp", endpoint)
-	if e != nil {
-		log.Fatal("listen error:", e)
+func (srv *Service) Compact(section string, dropped *int) error {
+	log.Println("[RPC] Compact", section)
+	if err := srv.session.check(section, rightPop); err != nil {
+		return err
+	}
+	n, err := db.Compact(section)
+	if err != nil {
+		return apiError(err)
 	}
-	rpc.Accept(l)
+	*dropped = n
+	return nil
 }
 
-func enableRPCHTTP(endpoint string) {
-	srv := new(Service)
+// RPC server of connection or request with own session
+func newRPCServer(s *session) *rpc.Server {
 	server := rpc.NewServer()
-	server.RegisterName("db", srv)
-	l, e := net.Listen("tcp", endpoint)
-	if e != nil {
-		log.Fatal("listen error:", e)
+	server.RegisterName("db", &Service{session: s})
+	return server
+}
+
+// Serve Go RPC connections. Each connection has own session
+func serveRPC(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			s, err := connSession(conn)
+			if err != nil {
+				log.Println("[RPC] Failed accept connection from", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			newRPCServer(s).ServeConn(conn)
+		}()
 	}
-	panic(http.Serve(l, server))
+}
+
+// Go RPC over HTTP. Session is authenticated by headers of CONNECT request
+func rpcHTTPHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := newSession(r.Header.Get("Authorization"), r.TLS)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", auth.challenge())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		newRPCServer(s).ServeHTTP(w, r)
+	}
+}
+
+func enableRPC(endpoint string) {
+	l := listen(endpoint)
+	panic(serveRPC(l))
+}
+
+func enableRPCHTTP(endpoint string) {
+	l := listen(endpoint)
+	panic(http.Serve(l, rpcHTTPHandler()))
 }
@@ -2,7 +2,10 @@ package main
 
 import (
 	"log"
+	"net"
 	"net/rpc"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -74,3 +77,215 @@ func TestRPCClient(t *testing.T) {
 	}
 
 }
+
+// Go RPC client of new database. Returned function stops server and removes stacks
+func startRPC(t *testing.T, location string, options ...fstack.Option) (*rpc.Client, func()) {
+	fsdb, err := fstack.NewDatabase(location, 3*time.Second, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveRPC(l)
+	client, err := rpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		l.Close()
+		db.Clean()
+	}
+}
+
+func testPush(t *testing.T, client *rpc.Client, section string) int {
+	push := api.PushArgs{Section: section}
+	push.Headers = map[string]string{"Name": "Alex"}
+	push.Body = []byte("Hello world")
+	var depth int
+	if err := client.Call("db.Push", push, &depth); err != nil {
+		t.Fatal(err)
+	}
+	return depth
+}
+
+func TestRPCGet(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpcgetdb")
+	defer stop()
+	depth := testPush(t, client, "test")
+	testPush(t, client, "test")
+
+	var message api.DataResult
+	err := client.Call("db.Get", api.IndexArgs{Section: "test", DepthIndex: depth}, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.DepthIndex != depth || string(message.Body) != "Hello world" || message.Headers["Name"] != "Alex" {
+		t.Fatal("Bad message by index", message)
+	}
+	err = client.Call("db.Get", api.IndexArgs{Section: "test", DepthIndex: 3}, &message)
+	if err == nil || err.Error() != api.ErrOutOfRange.Error() {
+		t.Fatal("Out of range expected:", err)
+	}
+}
+
+func TestRPCHistory(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpchistorydb")
+	defer stop()
+	testPush(t, client, "test")
+	depth := testPush(t, client, "test")
+
+	var history []api.DataResult
+	err := client.Call("db.History", api.HistoryArgs{Section: "test", Limit: 10}, &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].DepthIndex != depth || history[1].DepthIndex != depth-1 {
+		t.Fatal("Bad history", history)
+	}
+}
+
+func TestRPCCompact(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpccompactdb")
+	defer stop()
+	depth := testPush(t, client, "test")
+	testPush(t, client, "test")
+
+	var data api.DataResult
+	if err := client.Call("db.Pop", "test", &data); err != nil {
+		t.Fatal(err)
+	}
+	var dropped int
+	if err := client.Call("db.Compact", "test", &dropped); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("db.Pop", "test", &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.DepthIndex != depth || string(data.Body) != "Hello world" {
+		t.Fatal("Bad message after compaction", data)
+	}
+}
+
+func TestRPCPopWait(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpcwaitdb")
+	defer stop()
+
+	var data api.DataResult
+	err := client.Call("db.PopWait", api.PopWaitArgs{Section: "test", Timeout: 10 * time.Millisecond}, &data)
+	if err == nil || err.Error() != api.ErrSectionNotFound.Error() {
+		t.Fatal("Unknown section expected after wait:", err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		var depth int
+		client.Call("db.Push", api.PushArgs{Section: "test"}, &depth)
+	}()
+	err = client.Call("db.PopWait", api.PopWaitArgs{Section: "test", Timeout: 5 * time.Second}, &data)
+	if err != nil || data.DepthIndex != 1 {
+		t.Fatal("Pushed message is not popped", data, err)
+	}
+	err = client.Call("db.PopWait", api.PopWaitArgs{Section: "test", Timeout: 10 * time.Millisecond}, &data)
+	if err == nil || err.Error() != api.ErrStackIsEmpty.Error() {
+		t.Fatal("Empty stack expected after wait:", err)
+	}
+}
+
+func TestRPCWatch(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpcwatchdb")
+	defer stop()
+
+	var subscription uint64
+	if err := client.Call("db.Watch", "test", &subscription); err != nil {
+		t.Fatal(err)
+	}
+	depth := testPush(t, client, "test")
+	testPush(t, client, "other")
+
+	var events []api.Event
+	err := client.Call("db.Events", api.EventsArgs{ID: subscription, Timeout: time.Second}, &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != "push" || events[0].Section != "test" || events[0].Depth != depth {
+		t.Fatal("Bad events", events)
+	}
+	var unwatched bool
+	err = client.Call("db.Unwatch", subscription, &unwatched)
+	if err != nil || !unwatched {
+		t.Fatal("Unwatch failed", err)
+	}
+	err = client.Call("db.Events", api.EventsArgs{ID: subscription}, &events)
+	if err == nil || err.Error() != api.ErrUnknownWatch.Error() {
+		t.Fatal("Unknown subscription expected:", err)
+	}
+}
+
+func TestRPCPushSync(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpcsyncdb", fstack.Durability(fstack.SyncAlways, 0))
+	defer stop()
+
+	var pushed api.PushResult
+	if err := client.Call("db.PushSync", api.PushArgs{Section: "durable"}, &pushed); err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Durability != "always" || pushed.DepthIndex != 1 {
+		t.Fatal("Bad durability", pushed)
+	}
+}
+
+func TestRPCChildren(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpcchildrendb")
+	defer stop()
+	testPush(t, client, "test")
+	testPush(t, client, "orders/1")
+
+	var children []string
+	if err := client.Call("db.Children", "", &children); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(children)
+	if !reflect.DeepEqual(children, []string{"orders", "test"}) {
+		t.Fatal("Bad children of root", children)
+	}
+}
+
+func TestRPCPushBatch(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpcbatchdb")
+	defer stop()
+
+	push := api.PushArgs{Section: "test"}
+	push.Body = []byte("Hello world")
+	var batch []api.PushResult
+	if err := client.Call("db.PushBatch", []api.PushArgs{push, push}, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || batch[0].DepthIndex != 1 || batch[1].DepthIndex != 2 || batch[1].Durability != "none" {
+		t.Fatal("Bad batch result", batch)
+	}
+}
+
+func TestRPCTransact(t *testing.T) {
+	client, stop := startRPC(t, "test-data/rpctxdb")
+	defer stop()
+	testPush(t, client, "test")
+
+	var message api.Message
+	message.Body = []byte("moved")
+	var result []api.DataResult
+	err := client.Call("db.Transact", []api.TxOp{{Section: "moved", Message: message}, {Section: "test", Pop: true}}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].DepthIndex != 1 || string(result[1].Body) != "Hello world" {
+		t.Fatal("Bad transaction result", result)
+	}
+	var data api.DataResult
+	err = client.Call("db.Peak", "test", &data)
+	if err == nil || err.Error() != api.ErrStackIsEmpty.Error() {
+		t.Fatal("Popped message is kept:", err)
+	}
+}
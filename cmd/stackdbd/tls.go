@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Maximum duration of TLS handshake of RPC and RESP connections
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLS settings of all listeners. Certificate and client CA are read again on reload,
+// new settings are applied to new connections only
+type tlsFiles struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// Nil - listeners accept plain TCP connections
+var serverTLS *tlsFiles
+
+// Load certificate, key and optional CA of client certificates
+func newTLSFiles(certFile, keyFile, clientCAFile string) (*tlsFiles, error) {
+	if certFile == "" && keyFile == "" && clientCAFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both TLS certificate and key are required")
+	}
+	files := &tlsFiles{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	return files, files.reload()
+}
+
+// Read files again. Previous settings are kept on error
+func (t *tlsFiles) reload() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if t.clientCAFile != "" {
+		data, err := ioutil.ReadFile(t.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return errors.New("no certificates in " + t.clientCAFile)
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.cert, t.clientCAs = &cert, clientCAs
+	return nil
+}
+
+// Server config with current certificate for each handshake. Client certificates are required if client CA is set.
+// Protocols are offered by ALPN
+func (t *tlsFiles) config(protos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: protos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.lock.RLock()
+			defer t.lock.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   protos,
+				Certificates: []tls.Certificate{*t.cert},
+			}
+			if t.clientCAs != nil {
+				config.ClientCAs = t.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// Reload TLS files on SIGHUP
+func reloadTLSOnSignal(t *tlsFiles) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := t.reload(); err != nil {
+			log.Println("[TLS] Failed reload certificates, previous are used:", err)
+			continue
+		}
+		log.Println("[TLS] Certificates reloaded")
+	}
+}
+
+// Listen TCP endpoint with TLS if it's enabled
+func listen(endpoint string) net.Listener {
+	l, e := net.Listen("tcp", endpoint)
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+	if serverTLS != nil {
+		return tls.NewListener(l, serverTLS.config())
+	}
+	return l
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+	"github.com/reddec/file-stack-db/api/pb"
+	"github.com/reddec/file-stack-db/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Save certificate and key as PEM files
+func writeCertificate(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	writeTestFile(t, certFile, string(certPEM))
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})))
+}
+
+func (ca *testCA) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+}
+
+func TestTLS(t *testing.T) {
+	fsdb, err := fstack.NewDatabase("test-data/tlsdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = fsdb
+	defer db.Clean()
+	defer os.RemoveAll("test-data/auth")
+
+	serverCA, clientCA := newTestCA(t), newTestCA(t)
+	writeCertificate(t, serverCA.issue(t, "127.0.0.1"), "server.crt", "server.key")
+	writeTestFile(t, "clients.crt", clientCA.pem())
+	dir := "test-data/auth"
+	serverTLS, err = newTLSFiles(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "clients.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { serverTLS = nil }()
+	go reloadTLSOnSignal(serverTLS)
+	auth = &authConfig{certs: true}
+	defer func() { auth = nil }()
+	clientConfig := &tls.Config{RootCAs: serverCA.pool(), Certificates: []tls.Certificate{clientCA.issue(t, "carol")}}
+
+	// Go RPC: user is authenticated by client certificate
+	rpcListener := listen("127.0.0.1:0")
+	defer rpcListener.Close()
+	go serveRPC(rpcListener)
+	rpcClient := client.NewRPC(rpcListener.Addr().String(), client.TLS(clientConfig), client.PoolSize(1))
+	defer rpcClient.Close()
+	var pushed int
+	push := api.PushArgs{Section: "tls"}
+	push.Body = []byte("secret")
+	if err = rpcClient.Push(push, &pushed); err != nil || pushed != 1 {
+		t.Fatal("Bad push over TLS", pushed, err)
+	}
+	plain := client.NewRPC(rpcListener.Addr().String())
+	defer plain.Close()
+	if err = plain.Push(push, &pushed); err == nil {
+		t.Fatal("Plain connection is accepted by TLS listener")
+	}
+	anonymous := client.NewRPC(rpcListener.Addr().String(), client.TLS(&tls.Config{RootCAs: serverCA.pool()}))
+	defer anonymous.Close()
+	if err = anonymous.Push(push, &pushed); err == nil {
+		t.Fatal("Connection without client certificate is accepted")
+	}
+
+	// HTTP API
+	httpListener := listen("127.0.0.1:0")
+	defer httpListener.Close()
+	go http.Serve(httpListener, newRouter())
+	httpClient := client.NewHTTP("https://"+httpListener.Addr().String(), client.TLS(clientConfig))
+	defer httpClient.Close()
+	var data api.DataResult
+	if err = httpClient.Peak("tls", &data); err != nil || string(data.Body) != "secret" {
+		t.Fatal("Bad peak over HTTPS", data, err)
+	}
+
+	// gRPC
+	grpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := newGRPCServer()
+	go grpcServer.Serve(grpcListener)
+	defer grpcServer.Stop()
+	conn, err := grpc.NewClient(grpcListener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	message, err := pb.NewStackDBClient(conn).Peak(ctx, &pb.SectionRequest{Section: "tls"})
+	if err != nil || string(message.Body) != "secret" {
+		t.Fatal("Bad peak over gRPC with TLS", message, err)
+	}
+
+	// Reload by SIGHUP: new connections use new certificate, opened connections are kept
+	newServerCA := newTestCA(t)
+	writeCertificate(t, newServerCA.issue(t, "127.0.0.1"), "server.crt", "server.key")
+	if err = syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := &tls.Config{RootCAs: newServerCA.pool(), Certificates: clientConfig.Certificates}
+	for started := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		tlsConn, err := tls.Dial("tcp", rpcListener.Addr().String(), reloaded)
+		if err == nil {
+			tlsConn.Close()
+			break
+		}
+		if time.Since(started) > 5*time.Second {
+			t.Fatal("Certificate is not reloaded", err)
+		}
+	}
+	if err = rpcClient.Peak("tls", &data); err != nil {
+		t.Fatal("Opened connection is dropped by reload", err)
+	}
+	oldCA := client.NewRPC(rpcListener.Addr().String(), client.TLS(clientConfig))
+	defer oldCA.Close()
+	if err = oldCA.Peak("tls", &data); err == nil {
+		t.Fatal("Old certificate is used after reload")
+	}
+}
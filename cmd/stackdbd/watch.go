@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/reddec/file-stack-db"
+	"github.com/reddec/file-stack-db/api"
+)
+
+// Subscription of RPC client is removed if events were not requested during this time
+const subscriptionTTL = time.Minute
+
+func apiEvent(event fstack.Event) api.Event {
+	return api.Event{Type: string(event.Type), Section: event.Key, Depth: event.Depth, Time: event.Time}
+}
+
+// Server-Sent Events stream of changes in section (from path) or sections with prefix (from query)
+func watchEvents(w http.ResponseWriter, r *http.Request) {
+	section := mux.Vars(r)["key"]
+	if section == "" {
+		section = r.URL.Query().Get("prefix")
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+	watcher := db.Watch(section)
+	defer watcher.Close()
+	log.Println("[EVENTS]", "Watch section", section)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	for {
+		select {
+		case event := <-watcher.Events:
+			data, _ := json.Marshal(apiEvent(event))
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			log.Println("[EVENTS]", "Stop watching section", section)
+			return
+		}
+	}
+}
+
+// WebSocket stream of changes in sections with prefix (from query). Each message is JSON event
+func watchWebsocket(w http.ResponseWriter, r *http.Request) {
+	section := r.URL.Query().Get("prefix")
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	defer ws.Close()
+	watcher := db.Watch(section)
+	defer watcher.Close()
+	log.Println("[WS]", "Watch section", section)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := ws.ReadFrame()
+			if err != nil || opcode == wsClose {
+				return
+			}
+			if opcode == wsPing {
+				ws.writeFrame(wsPong, payload)
+			}
+		}
+	}()
+	for {
+		select {
+		case event := <-watcher.Events:
+			data, _ := json.Marshal(apiEvent(event))
+			if ws.WriteText(data) != nil {
+				return
+			}
+		case <-closed:
+			log.Println("[WS]", "Stop watching section", section)
+			return
+		}
+	}
+}
+
+// RPC subscriptions
+type subscription struct {
+	user     string // owner of subscription
+	watcher  *fstack.Watcher
+	lastPoll time.Time
+	poll     sync.Mutex
+}
+
+var (
+	subscriptionsLock sync.Mutex
+	subscriptions     = map[uint64]*subscription{}
+	lastSubscription  uint64
+	subscriptionsGC   sync.Once
+)
+
+// Remove subscriptions without polling
+func expireSubscriptions() {
+	for _ = range time.Tick(subscriptionTTL / 2) {
+		subscriptionsLock.Lock()
+		for id, sub := range subscriptions {
+			if time.Since(sub.lastPoll) > subscriptionTTL {
+				log.Println("[RPC] Subscription", id, "expired")
+				sub.watcher.Close()
+				delete(subscriptions, id)
+			}
+		}
+		subscriptionsLock.Unlock()
+	}
+}
+
+func (srv *Service) Watch(prefix string, subscriptionID *uint64) error {
+	if err := srv.session.check(prefix, rightRead); err != nil {
+		return err
+	}
+	user, _ := srv.session.identity()
+	subscriptionsGC.Do(func() { go expireSubscriptions() })
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	lastSubscription++
+	subscriptions[lastSubscription] = &subscription{user: user, watcher: db.Watch(prefix), lastPoll: time.Now()}
+	log.Println("[RPC] Watch", prefix, "subscription", lastSubscription)
+	*subscriptionID = lastSubscription
+	return nil
+}
+
+func (srv *Service) Events(args api.EventsArgs, result *[]api.Event) error {
+	subscriptionsLock.Lock()
+	sub, ok := subscriptions[args.ID]
+	ok = ok && srv.owns(sub)
+	if ok {
+		sub.lastPoll = time.Now()
+	}
+	subscriptionsLock.Unlock()
+	if !ok {
+		return api.ErrUnknownWatch
+	}
+	sub.poll.Lock()
+	defer sub.poll.Unlock()
+	events := []api.Event{}
+	timer := time.NewTimer(args.Timeout)
+	defer timer.Stop()
+	// Wait for first event
+	select {
+	case event, ok := <-sub.watcher.Events:
+		if !ok {
+			return api.ErrUnknownWatch
+		}
+		events = append(events, apiEvent(event))
+	case <-timer.C:
+	}
+	// Get all buffered events
+collect:
+	for len(events) > 0 {
+		select {
+		case event, ok := <-sub.watcher.Events:
+			if !ok {
+				break collect
+			}
+			events = append(events, apiEvent(event))
+		default:
+			break collect
+		}
+	}
+	*result = events
+	return nil
+}
+
+func (srv *Service) Unwatch(subscriptionID uint64, ok *bool) error {
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	sub, found := subscriptions[subscriptionID]
+	found = found && srv.owns(sub)
+	if found {
+		sub.watcher.Close()
+		delete(subscriptions, subscriptionID)
+		log.Println("[RPC] Unwatch subscription", subscriptionID)
+	}
+	*ok = found
+	return nil
+}
+
+// Subscriptions are shared by connections of same user
+func (srv *Service) owns(sub *subscription) bool {
+	user, _ := srv.session.identity()
+	return auth == nil || sub.user == user
+}
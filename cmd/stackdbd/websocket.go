@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Minimal server side of WebSocket protocol (RFC 6455): only unfragmented server text messages
+// and reading of client control frames
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	write  sync.Mutex
+}
+
+// Upgrade HTTP connection to WebSocket
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !headerContains(r.Header, "Connection", "upgrade") {
+		return nil, errors.New("websocket upgrade required")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		return nil, errors.New("websocket key required")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection couldn't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Write one frame without masking
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch size := len(payload); {
+	case size < 126:
+		header[1] = byte(size)
+	case size <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(size))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(size))
+	}
+	ws.write.Lock()
+	defer ws.write.Unlock()
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+// WriteText - send text message
+func (ws *websocketConn) WriteText(data []byte) error { return ws.writeFrame(wsText, data) }
+
+// ReadFrame - read one (masked) frame from client
+func (ws *websocketConn) ReadFrame() (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = header[0] & 0x0F
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > maxWebsocketFrame {
+		return 0, nil, errors.New("websocket frame is too big")
+	}
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err = io.ReadFull(ws.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+// Maximum size of frame from client (clients send only control frames)
+const maxWebsocketFrame = 64 * 1024
+
+// Close connection with close frame
+func (ws *websocketConn) Close() error {
+	ws.writeFrame(wsClose, nil)
+	return ws.conn.Close()
+}
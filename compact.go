@@ -0,0 +1,79 @@
+package fstack
+
+import (
+	"log"
+	"time"
+)
+
+// Size of background compaction queue
+const compactQueueSize = 1024
+
+// Compact - rewrite stack file without messages dropped by retention policy. Stack stays
+// readable and writable during compaction. Returns number of dropped messages
+func (db *Database) Compact(key string) (int, error) {
+	s, err := db.Find(key, false)
+	if err != nil {
+		return 0, err
+	}
+	if s == nil {
+		return 0, ErrNotFound
+	}
+	segments, err := s.Segments()
+	if err != nil {
+		return 0, err
+	}
+	drop := db.RetentionOf(key).excess(segments, time.Now())
+	dropped, err := s.Compact(drop)
+	if err != nil {
+		return 0, err
+	}
+	log.Println("Stack", db.fullKey(key), "compacted, dropped", dropped, "segments")
+	return dropped, nil
+}
+
+// ScheduleCompact - add stack to queue of background compactor. Returns false if queue is full.
+// Stack already in queue is not added twice
+func (db *Database) ScheduleCompact(key string) bool {
+	key = db.fullKey(key)
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+	if db.compactStopped {
+		return false
+	}
+	if db.compactPending[key] {
+		return true
+	}
+	select {
+	case db.compactQueue <- key:
+		db.compactPending[key] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// ScheduleCompactAll - add all known stacks in database (or sub-section) to queue of background compactor.
+// Returns number of scheduled stacks
+func (db *Database) ScheduleCompactAll() int {
+	scheduled := 0
+	for _, name := range db.Names() {
+		if db.ScheduleCompact(name) {
+			scheduled++
+		}
+	}
+	return scheduled
+}
+
+// Background compactor: compacts stacks from queue one-by-one
+func (db *Database) compactor() {
+	root := &Database{storage: db.storage}
+	for key := range db.compactQueue {
+		db.compactLock.Lock()
+		delete(db.compactPending, key)
+		db.compactLock.Unlock()
+		_, err := root.Compact(key)
+		if err != nil && err != ErrNotFound {
+			log.Println("Failed compact stack", key, err)
+		}
+	}
+}
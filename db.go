@@ -1,44 +1,301 @@
 package fstack
 
 import (
+	"container/list"
+	"errors"
 	"io"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/reddec/file-stack"
+	"github.com/reddec/file-stack-db/filestack"
+)
+
+// SectionSeparator splits key to sub-sections. Each sub-section is stored as directory
+const SectionSeparator = "/"
+
+// StackFile - name of stack file in directory of key. Directory of key also keeps sub-sections of key,
+// so key may be a stack and a section at the same time
+const StackFile = "#stack"
+
+// Common errors
+var (
+	ErrInvalidKey = errors.New("invalid key")              // Key has no name after normalization
+	ErrNotFound   = errors.New("stack not found")          // Stack is not allocated
+	ErrOutOfRange = errors.New("depth index out of range") // No message with such depth index
+	ErrEmpty      = errors.New("stack is empty")
+	ErrChanged    = errors.New("last message is changed by concurrent operation")
+	ErrCorrupted  = filestack.ErrCorrupted // Checksum of message is not matched to content
+	ErrNotStack   = filestack.ErrNotStack  // File of key is not a stack: it is kept untouched
 )
 
 // Database of file stacks
 type Database struct {
 	io.Closer
+	*storage
+	prefix string // Sub-section of root database (empty for root)
+}
+
+// Segment - message of stack with depth index
+type Segment struct {
+	Depth  int    // Depth index of message (1 - first pushed message)
+	Header []byte // Message header
+	Data   []byte // Message body
+}
+
+// Shared state of root database and all sub-sections views
+type storage struct {
 	fileLock  sync.RWMutex
-	files     map[string]*fstack.Stack
+	files     map[string]*filestack.Stack
 	collector *time.Ticker
 	keepAlive time.Duration
 	rootDir   string
+	// Pool of opened files
+	maxOpen  int
+	lruLock  sync.Mutex
+	lru      *list.List // Recently used stacks in front
+	lruItems map[string]*list.Element
+	// Retention policies by section
+	retentionLock     sync.RWMutex
+	retention         map[string]Retention
+	retentionInterval time.Duration
+	retentionTicker   *time.Ticker
+	// Background compaction
+	compactLock    sync.Mutex
+	compactQueue   chan string
+	compactPending map[string]bool
+	compactStopped bool
+	// Waiters of pushed messages by key
+	waitLock sync.Mutex
+	waiters  map[string]chan struct{}
+	// Watchers of stack changes
+	watchLock sync.RWMutex
+	watchers  map[*Watcher]bool
+	// Durability
+	syncMode     SyncMode
+	syncInterval time.Duration
+	syncTicker   *time.Ticker
+	syncLock     sync.Mutex
+	dirty        map[*filestack.Stack]bool // Stacks changed after last sync
+	dirtyRoot    bool                      // Entries of root dir (removed journals) are changed after last sync
+	// Locks of stack keys for push, pop and transactions
+	keyLocksLock sync.Mutex
+	keyLocks     map[string]*keyLock
+	// Cached metadata of stacks
+	metaLock sync.Mutex
+	meta     map[string]map[string]string
+}
+
+// Opened files of stack in pool: messages and index
+const filesPerStack = 2
+
+// Item of opened files pool
+type lruEntry struct {
+	key   string
+	stack *filestack.Stack
+}
+
+// Option of database
+type Option func(db *Database)
+
+// MaxOpenFiles - keep at most n stack files opened. Every opened stack uses two files (messages and index),
+// so at most n/2 stacks (but at least one) are kept opened. Least recently used stacks
+// are closed and automatically reopened on demand. Zero or negative value means no limit
+func MaxOpenFiles(n int) Option {
+	return func(db *Database) { db.maxOpen = n }
+}
+
+// CleanKey - normalize key: remove empty sub-sections and leading/trailing separators
+func CleanKey(key string) string {
+	parts := strings.Split(key, SectionSeparator)
+	clean := parts[:0]
+	for _, part := range parts {
+		if part != "" {
+			clean = append(clean, part)
+		}
+	}
+	return strings.Join(clean, SectionSeparator)
+}
+
+// Escape one part of key to file name
+func escapeName(part string) string {
+	switch part {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	return url.QueryEscape(part)
+}
+
+// Full key in root database
+func (db *Database) fullKey(key string) string {
+	return CleanKey(db.prefix + SectionSeparator + key)
+}
+
+// Key relative to current sub-section. Returns false if key is not inside sub-section
+func (db *Database) relativeKey(fullKey string) (string, bool) {
+	if db.prefix == "" {
+		return fullKey, true
+	}
+	if !strings.HasPrefix(fullKey, db.prefix+SectionSeparator) {
+		return "", false
+	}
+	return fullKey[len(db.prefix)+len(SectionSeparator):], true
+}
+
+// Location of directory of key (stack file and sub-sections) in file system by full key
+func (st *storage) dirName(key string) string {
+	parts := []string{st.rootDir}
+	if key != "" {
+		for _, part := range strings.Split(key, SectionSeparator) {
+			parts = append(parts, escapeName(part))
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// Location of stack file in file system by full key
+func (st *storage) fileName(key string) string {
+	return filepath.Join(st.dirName(key), StackFile)
+}
+
+// Key by name of directory (or file of previous versions). Each directory is a sub-section
+func (st *storage) keyName(fileName string) (string, error) {
+	rel, err := filepath.Rel(st.rootDir, fileName)
+	if err != nil || rel == "." {
+		return "", err
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		parts[i], err = url.QueryUnescape(part)
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(parts, SectionSeparator), nil
+}
+
+// Mark stack as recently used and close least recently used stacks above limit of opened files
+func (st *storage) touch(key string, stack *filestack.Stack) {
+	if st.maxOpen <= 0 {
+		return
+	}
+	var evicted []*filestack.Stack
+	st.lruLock.Lock()
+	if item, ok := st.lruItems[key]; ok {
+		st.lru.MoveToFront(item)
+	} else {
+		st.lruItems[key] = st.lru.PushFront(lruEntry{key: key, stack: stack})
+	}
+	for st.lru.Len() > 1 && st.lru.Len()*filesPerStack > st.maxOpen {
+		item := st.lru.Back()
+		entry := item.Value.(lruEntry)
+		st.lru.Remove(item)
+		delete(st.lruItems, entry.key)
+		evicted = append(evicted, entry.stack)
+	}
+	st.lruLock.Unlock()
+	for _, s := range evicted {
+		st.closeStack(s)
+	}
+}
+
+// Close stack which is not used for a while. Changes which are not synced yet are synced before close,
+// because group commit doesn't reopen closed stacks
+func (st *storage) closeStack(s *filestack.Stack) {
+	if st.forgetDirty(s) || st.syncMode == SyncAlways {
+		if err := s.Sync(); err != nil {
+			log.Println("Failed sync stack before close:", err)
+		}
+	}
+	s.Close()
+}
+
+// Remove stack from pool of opened files
+func (st *storage) forget(key string) {
+	if st.maxOpen <= 0 {
+		return
+	}
+	st.lruLock.Lock()
+	defer st.lruLock.Unlock()
+	if item, ok := st.lruItems[key]; ok {
+		st.lru.Remove(item)
+		delete(st.lruItems, key)
+	}
+}
+
+// Service files of stack (index, temporary files) contain symbol which is always escaped in keys
+func isServiceFile(name string) bool { return strings.Contains(name, "#") && name != StackFile }
+
+// Remove stack file and all service files of stack
+func removeStackFiles(fileName string) error {
+	os.Remove(fileName + filestack.IndexSuffix)
+	os.Remove(fileName + MetaSuffix)
+	return os.Remove(fileName)
+}
+
+// Move stack file with service files to new location. Directory of new location may be occupied
+// by the same stack file (key of previous version without own directory)
+func moveStackFiles(from, to string) error {
+	if filepath.Dir(to) == filepath.Clean(from) {
+		tmp := from + filestack.TempSuffix
+		if err := moveStackFiles(from, tmp); err != nil {
+			return err
+		}
+		from = tmp
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	for _, suffix := range []string{filestack.IndexSuffix, MetaSuffix} {
+		if err := os.Rename(from+suffix, to+suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(from, to)
+}
+
+// Remove empty sub-section directories from dir up to the root dir
+func (st *storage) removeEmptyDirs(dir string) {
+	root := filepath.Clean(st.rootDir)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
 }
 
-//Find a stack or create new
-func (db *Database) Find(key string, create bool) (*fstack.Stack, error) {
+// Find a stack or create new. Key may contain sub-sections separated by SectionSeparator
+func (db *Database) Find(key string, create bool) (*filestack.Stack, error) {
+	key = db.fullKey(key)
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
 	var err error
 	// Double check
 	db.fileLock.RLock()
 	fs, ok := db.files[key]
 	db.fileLock.RUnlock()
 	if !ok {
-		fileName := filepath.Join(db.rootDir, url.QueryEscape(key))
+		fileName := db.fileName(key)
 		db.fileLock.Lock()
 		defer db.fileLock.Unlock()
 		if _, err := os.Stat(fileName); os.IsNotExist(err) && !create {
 			return nil, nil
 		}
 		if fs, ok = db.files[key]; !ok {
+			// Directory of key (or of its parent section) is a file of other application or of not scanned previous layout
+			if db.insideFile(fileName) {
+				return nil, ErrNotStack
+			}
 			log.Println("New stack allocated at", fileName)
-			fs, err = fstack.OpenStack(fileName)
+			fs, err = db.openStack(fileName)
 		}
 		if err == nil {
 			db.files[key] = fs
@@ -47,11 +304,59 @@ func (db *Database) Find(key string, create bool) (*fstack.Stack, error) {
 			return nil, err
 		}
 	}
+	db.touch(key, fs)
 	return fs, nil
 }
 
+// Check that directory of stack file or of any parent section is occupied by file
+func (st *storage) insideFile(fileName string) bool {
+	root := filepath.Clean(st.rootDir)
+	for dir := filepath.Dir(fileName); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if info, err := os.Stat(dir); err == nil {
+			return !info.IsDir()
+		}
+	}
+	return false
+}
+
+// Open stack file and create directories of sub-sections. Entries of new stack files and directories are synced
+// in SyncAlways mode, otherwise first acknowledged push to new section may be lost after crash
+func (st *storage) openStack(fileName string) (*filestack.Stack, error) {
+	dir := filepath.Dir(fileName)
+	_, err := os.Stat(fileName)
+	created := os.IsNotExist(err)
+	var newDirs []string
+	for parent := dir; ; parent = filepath.Dir(parent) {
+		if _, err := os.Stat(parent); !os.IsNotExist(err) {
+			break
+		}
+		newDirs = append(newDirs, parent)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s, err := filestack.OpenStack(fileName)
+	if err != nil || !created || st.syncMode != SyncAlways {
+		return s, err
+	}
+	// Index file is created by sync
+	if err = s.Sync(); err == nil {
+		err = syncDir(dir)
+	}
+	for _, newDir := range newDirs {
+		if err == nil {
+			err = syncDir(filepath.Dir(newDir))
+		}
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
 // Get stack or create new. Panics on errors
-func (db *Database) Get(key string) *fstack.Stack {
+func (db *Database) Get(key string) *filestack.Stack {
 	s, err := db.Find(key, true)
 	if err != nil {
 		panic(err)
@@ -59,15 +364,102 @@ func (db *Database) Get(key string) *fstack.Stack {
 	return s
 }
 
+// Push message to stack (stack is created if not exists) and notify waiters. Message is synced by durability
+// mode (see Durability option). Returns new depth of stack
+func (db *Database) Push(key string, header, data []byte) (int, error) {
+	defer db.lockKeys(db.fullKey(key))()
+	s, err := db.Find(key, true)
+	if err != nil {
+		return -1, err
+	}
+	depth, err := s.Push(header, data)
+	if err != nil {
+		return -1, err
+	}
+	// Message is not acknowledged if it couldn't be synced
+	if err = db.syncPushed(s); err != nil {
+		return -1, err
+	}
+	db.notify(db.fullKey(key))
+	db.emit(EventPush, db.fullKey(key), depth)
+	return depth, nil
+}
+
+// Peak - get last message from stack without removing. Corrupted message is returned with ErrCorrupted
+func (db *Database) Peak(key string) (Segment, error) {
+	return db.last(key, false)
+}
+
+// Pop - get and remove last message from stack. Corrupted message is removed and returned with ErrCorrupted
+func (db *Database) Pop(key string) (Segment, error) {
+	return db.last(key, true)
+}
+
+func (db *Database) last(key string, remove bool) (Segment, error) {
+	var segment Segment
+	defer db.lockKeys(db.fullKey(key))()
+	s, err := db.Find(key, false)
+	if err != nil {
+		return segment, err
+	}
+	if s == nil {
+		return segment, ErrNotFound
+	}
+	// Non-atomic: depth may be changed by concurrent operation
+	segment.Depth = s.Depth()
+	if remove {
+		segment.Header, segment.Data, err = s.Pop()
+	} else {
+		segment.Header, segment.Data, err = s.Peak()
+	}
+	// Corrupted message is returned as is (and removed by pop)
+	if err != nil && err != ErrCorrupted {
+		return segment, err
+	}
+	if segment.Header == nil || segment.Data == nil {
+		return segment, ErrEmpty
+	}
+	if remove {
+		db.emit(EventPop, db.fullKey(key), segment.Depth-1)
+	}
+	return segment, err
+}
+
+// Sub - view of database scoped to sub-section. View shares opened stacks with parent database.
+// Close of view closes only stacks inside sub-section and does not stop stack collector
+func (db *Database) Sub(prefix string) *Database {
+	return &Database{storage: db.storage, prefix: db.fullKey(prefix)}
+}
+
 // Close all allocated stacks and stops stack collector.
 // Never use database again after close
 func (db *Database) Close() error {
 	db.fileLock.Lock()
 	defer db.fileLock.Unlock()
-	for _, s := range db.files {
-		s.Close()
+	if db.prefix == "" {
+		db.syncDirty()
+	}
+	for key, s := range db.files {
+		if _, ok := db.relativeKey(key); ok {
+			s.Close()
+			db.forget(key)
+		}
+	}
+	if db.prefix == "" {
+		db.collector.Stop()
+		if db.retentionTicker != nil {
+			db.retentionTicker.Stop()
+		}
+		if db.syncTicker != nil {
+			db.syncTicker.Stop()
+		}
+		db.compactLock.Lock()
+		if !db.compactStopped {
+			db.compactStopped = true
+			close(db.compactQueue)
+		}
+		db.compactLock.Unlock()
 	}
-	db.collector.Stop()
 	return nil
 }
 
@@ -77,9 +469,10 @@ func (db *Database) cleanup() {
 			db.fileLock.RLock()
 			defer db.fileLock.RUnlock()
 			n := time.Now()
-			for _, s := range db.files {
+			for key, s := range db.files {
 				if n.Sub(s.LastAccess()) > db.keepAlive {
-					s.Close()
+					db.closeStack(s)
+					db.forget(key)
 				}
 			}
 		}()
@@ -88,95 +481,219 @@ func (db *Database) cleanup() {
 
 // Remove stack from database and file system
 func (db *Database) Remove(key string) error {
+	key = db.fullKey(key)
+	defer db.lockKeys(key)()
+	// Files of not known stack are not removed
 	db.fileLock.RLock()
-	fs, ok := db.files[key]
+	_, ok := db.files[key]
+	db.fileLock.RUnlock()
 	if !ok {
-		db.fileLock.RUnlock()
 		return nil
 	}
-	db.fileLock.RUnlock()
-	db.fileLock.Lock()
-	defer db.fileLock.Unlock()
-	fs, ok = db.files[key]
-	if ok {
-		fileName := filepath.Join(db.rootDir, url.QueryEscape(key))
+	return db.removeStack(key)
+}
+
+// Close stack by full key if it is opened and remove its files. Caller holds lock of key
+func (st *storage) removeStack(key string) error {
+	st.fileLock.Lock()
+	defer st.fileLock.Unlock()
+	if fs, ok := st.files[key]; ok {
+		st.forgetDirty(fs)
 		fs.Close()
-		delete(db.files, key)
-		return os.Remove(fileName)
+		delete(st.files, key)
+		st.forget(key)
+		st.forgetMeta(key)
 	}
-	return nil
+	fileName := st.fileName(key)
+	err := removeStackFiles(fileName)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	st.removeEmptyDirs(filepath.Dir(fileName))
+	return err
 }
 
-// Clean and remove all stacks in database from filesystem
+// Clean and remove all stacks in database (or sub-section) from filesystem
 func (db *Database) Clean() error {
 	db.fileLock.Lock()
 	defer db.fileLock.Unlock()
 	var err error
 	for key, s := range db.files {
+		if _, ok := db.relativeKey(key); !ok {
+			continue
+		}
+		db.forgetDirty(s)
 		s.Close()
-		fileName := filepath.Join(db.rootDir, url.QueryEscape(key))
-		e := os.Remove(fileName)
+		fileName := db.fileName(key)
+		e := removeStackFiles(fileName)
 		if err == nil {
 			err = e
 		}
+		delete(db.files, key)
+		db.forget(key)
+		db.forgetMeta(key)
+		db.removeEmptyDirs(filepath.Dir(fileName))
 	}
-	db.files = nil
 	return err
 }
 
-// Scan root dir for allocated stacks
-// Warning! All files in root dir will be interpreted as stacks
+// Scan root dir (or sub-section dir) for allocated stacks. Sub-directories are scanned as sub-sections.
+// Stacks saved by previous versions in file named by key (or with escaped separator in name) are moved to
+// directories of keys. Files which are not stacks (see filestack.CheckFile) are skipped. Transactions interrupted
+// by crash are undone and temporary files of interrupted pushes are removed before scanning of root database
 func (db *Database) Scan() error {
+	if db.prefix == "" {
+		if err := db.recoverTx(); err != nil {
+			return err
+		}
+		if err := db.removeSpools(); err != nil {
+			return err
+		}
+	}
 	db.fileLock.Lock()
 	defer db.fileLock.Unlock()
-	return filepath.Walk(db.rootDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
+	root := db.dirName(db.prefix)
+	if _, err := os.Stat(root); os.IsNotExist(err) && db.prefix != "" {
+		return nil
+	}
+	var stacks, previous []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || isServiceFile(info.Name()) {
+			return nil
+		}
+		if _, _, err := filestack.CheckFile(path); err == filestack.ErrNotStack || err == filestack.ErrUnsupportedVersion {
+			log.Println("Skip file at", path, "-", err)
 			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Name() == StackFile {
+			stacks = append(stacks, path)
+		} else {
+			previous = append(previous, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Files named by key occupy directories of own keys, so they are moved before flat files
+	sort.SliceStable(previous, func(i, j int) bool {
+		return !strings.Contains(filepath.Base(previous[i]), "%2F") && strings.Contains(filepath.Base(previous[j]), "%2F")
+	})
+	for _, path := range previous {
+		key, err := db.keyName(path)
+		if err != nil {
+			return err
+		}
+		if key = CleanKey(key); key == "" {
+			continue
+		}
+		fileName := db.fileName(key)
+		if _, err := os.Stat(fileName); err == nil {
+			log.Println("Skip stack at", path, "- key", key, "already allocated at", fileName)
+			continue
+		}
+		if err = moveStackFiles(path, fileName); err != nil {
+			return err
 		}
-		key, err := url.QueryUnescape(info.Name())
+		log.Println("Stack at", path, "moved to", fileName)
+		stacks = append(stacks, fileName)
+	}
+	for _, fileName := range stacks {
+		key, err := db.keyName(filepath.Dir(fileName))
 		if err != nil {
 			return err
 		}
+		if _, ok := db.relativeKey(key); !ok || key == "" || db.fileName(key) != filepath.Clean(fileName) {
+			continue
+		}
 		if _, ok := db.files[key]; !ok {
-			fileName := filepath.Join(db.rootDir, info.Name())
-			stack, err := fstack.OpenStack(fileName)
+			stack, err := filestack.OpenStack(fileName)
 			if err != nil {
 				return err
 			}
 			log.Println("Found stack allocated at", fileName, "mapped to", key, "with", stack.Depth(), "segments")
 			db.files[key] = stack
+			db.touch(key, stack)
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
-// Names of known stacks in the database
+// Names of known stacks in the database (or sub-section). Names in sub-section are relative
 func (db *Database) Names() []string {
 	db.fileLock.RLock()
 	defer db.fileLock.RUnlock()
 	names := []string{}
-	for name := range db.files {
+	for key := range db.files {
+		if name, ok := db.relativeKey(key); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Children - sorted names of direct children (stacks and sub-sections) of known stacks in section.
+// Empty section means current database (or sub-section)
+func (db *Database) Children(section string) []string {
+	sub := db.Sub(section)
+	unique := map[string]bool{}
+	for _, name := range sub.Names() {
+		unique[strings.SplitN(name, SectionSeparator, 2)[0]] = true
+	}
+	names := []string{}
+	for name := range unique {
 		names = append(names, name)
 	}
+	sort.Strings(names)
 	return names
 }
 
-//NewDatabase - create new database and start stack collector (closes outaded stack)
-func NewDatabase(rootDir string, keepAlive time.Duration) (*Database, error) {
+// NewDatabase - create new database and start stack collector (closes outaded stack)
+// with background compactor and retention policies applier (if interval defined)
+func NewDatabase(rootDir string, keepAlive time.Duration, options ...Option) (*Database, error) {
 	err := os.MkdirAll(rootDir, 0755)
 	if err != nil {
 		return nil, err
 	}
-	db := &Database{
-		files:     make(map[string]*fstack.Stack),
-		rootDir:   rootDir,
-		keepAlive: keepAlive,
-		collector: time.NewTicker(keepAlive / 3),
+	db := &Database{storage: &storage{
+		files:          make(map[string]*filestack.Stack),
+		rootDir:        rootDir,
+		keepAlive:      keepAlive,
+		collector:      time.NewTicker(keepAlive / 3),
+		lru:            list.New(),
+		lruItems:       make(map[string]*list.Element),
+		retention:      make(map[string]Retention),
+		compactQueue:   make(chan string, compactQueueSize),
+		compactPending: make(map[string]bool),
+		waiters:        make(map[string]chan struct{}),
+		watchers:       make(map[*Watcher]bool),
+		dirty:          make(map[*filestack.Stack]bool),
+		keyLocks:       make(map[string]*keyLock),
+		meta:           make(map[string]map[string]string),
+	}}
+	for _, option := range options {
+		option(db)
 	}
 
 	go db.cleanup()
+	go db.compactor()
+	if db.retentionInterval > 0 {
+		db.retentionTicker = time.NewTicker(db.retentionInterval)
+		go db.retainer()
+	}
+	if db.syncMode == SyncInterval {
+		if db.syncInterval <= 0 {
+			db.syncInterval = defaultSyncInterval
+		}
+		db.syncTicker = time.NewTicker(db.syncInterval)
+		go db.syncer()
+	}
 	return db, nil
 }
 
-// TODO: Sub sections?
 // TODO: HTT API names
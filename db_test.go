@@ -1,9 +1,18 @@
 package fstack
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/reddec/file-stack-db/filestack"
 )
 
 func TestSimpleDB(t *testing.T) {
@@ -47,3 +56,1159 @@ func TestSimpleDB(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSubSections(t *testing.T) {
+	db, err := NewDatabase("./test-data/subdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"sensors/room1/temp", "sensors/room1/humidity", "sensors/room2/temp", "/system//uptime/"} {
+		_, err = db.Get(key).Push([]byte("headers"), []byte("value of "+key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat("./test-data/subdb/sensors/room1/temp"); err != nil {
+		t.Fatal("Sub-section must be stored as directory:", err)
+	}
+	sensors := db.Sub("sensors")
+	if len(sensors.Names()) != 3 {
+		t.Fatal("Names in sub-section:", sensors.Names())
+	}
+	if children := db.Children("sensors"); len(children) != 2 || children[0] != "room1" || children[1] != "room2" {
+		t.Fatal("Children of sub-section:", children)
+	}
+	if s, err := sensors.Find("room2/temp", false); err != nil || s == nil || s.Depth() != 1 {
+		t.Fatal("Find in sub-section:", s, err)
+	}
+	if s, err := db.Find("system/uptime", false); err != nil || s == nil {
+		t.Fatal("Normalized key not found:", err)
+	}
+	if _, err := db.Find("//", true); err != ErrInvalidKey {
+		t.Fatal("Empty key must be rejected:", err)
+	}
+	// Stack and its sub-section at the same key
+	for _, key := range []string{"sensors/room2", "sensors/room2/temp/min"} {
+		if _, err = db.Push(key, []byte("headers"), []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if children := db.Children("sensors/room2"); len(children) != 1 || children[0] != "temp" {
+		t.Fatal("Children of stack with sub-section:", children)
+	}
+	if segment, err := db.Peak("sensors/room2/temp"); err != nil || string(segment.Data) != "value of sensors/room2/temp" {
+		t.Fatal("Stack with sub-section:", segment, err)
+	}
+	if segment, err := db.Peak("sensors/room2"); err != nil || string(segment.Data) != "value of sensors/room2" {
+		t.Fatal("Stack of section:", segment, err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDatabase("./test-data/subdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room1 := db.Sub("sensors/room1")
+	err = room1.Scan()
+	if err != nil {
+		t.Fatal("Scan sub-section:", err)
+	}
+	if len(db.Names()) != 2 {
+		t.Fatal("Only sub-section must be scanned:", db.Names())
+	}
+	err = db.Scan()
+	if err != nil {
+		t.Fatal("Scan:", err)
+	}
+	if len(db.Names()) != 6 {
+		t.Fatal("Scan names:", db.Names())
+	}
+	err = room1.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Names()) != 4 {
+		t.Fatal("Clean of sub-section must remove only sub-section:", db.Names())
+	}
+	if _, err := os.Stat("./test-data/subdb/sensors/room1"); !os.IsNotExist(err) {
+		t.Fatal("Empty sub-section directory must be removed:", err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	db, err := NewDatabase("./test-data/lrudb", 3*time.Second, MaxOpenFiles(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fds, _ := ioutil.ReadDir("/proc/self/fd")
+	opened := len(fds)
+	for i := 0; i < 20; i++ {
+		_, err = db.Get(fmt.Sprintf("key-%v", i)).Push([]byte("headers"), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.lru.Len()*filesPerStack > 5 {
+			t.Fatal("Too many opened stacks:", db.lru.Len())
+		}
+	}
+	if _, ok := db.lruItems["key-0"]; ok {
+		t.Fatal("Least recently used stack must be closed")
+	}
+	// Retention scan must not open stacks outside of pool
+	db.SetRetention("", Retention{MaxDepth: 10})
+	if err = db.ApplyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if db.lru.Len()*filesPerStack > 5 {
+		t.Fatal("Too many opened stacks after retention:", db.lru.Len())
+	}
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil && len(fds)-opened > 5 {
+		t.Fatal("Too many opened files after retention:", len(fds)-opened)
+	}
+	// Reopen on demand
+	_, data, err := db.Get("key-0").Peak()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0" {
+		t.Fatal("Bad data after reopen:", string(data))
+	}
+	if _, ok := db.lruItems["key-0"]; !ok {
+		t.Fatal("Reopened stack must be in pool")
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.lru.Len() != 0 {
+		t.Fatal("Pool must be empty after clean")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	db, err := NewDatabase("./test-data/retentiondb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		for _, key := range []string{"logs/depth", "logs/bytes", "events"} {
+			_, err = db.Get(key).Push([]byte("h"), []byte(fmt.Sprint(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get("events").Push([]byte("h"), []byte("fresh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetRetention("logs", Retention{MaxDepth: 3})
+	db.SetRetention("logs/bytes", Retention{MaxBytes: 2 * (56 + 2)})
+	db.SetRetention("events", Retention{MaxAge: 50 * time.Millisecond})
+	if db.Sub("logs").RetentionOf("depth").MaxDepth != 3 {
+		t.Fatal("Policy of parent section must be applied")
+	}
+	err = db.ApplyRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, depth := range map[string]int{"logs/depth": 3, "logs/bytes": 2, "events": 1} {
+		if d := db.Get(key).Depth(); d != depth {
+			t.Fatal("Bad depth of", key, "after retention:", d)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDatabase("./test-data/retentiondb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	err = db.Get("logs/depth").IterateBackward(func(depth int, header io.Reader, body io.Reader) bool {
+		data, _ := ioutil.ReadAll(body)
+		values = append(values, string(data))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(values, ",") != "9,8,7" {
+		t.Fatal("Bad history after retention:", values)
+	}
+	_, data, err := db.Get("events").Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "fresh" || db.Get("events").Depth() != 0 {
+		t.Fatal("Bad data after retention:", string(data))
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactOnline(t *testing.T) {
+	db, err := NewDatabase("./test-data/compactdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stack := db.Get("queue")
+	for i := 0; i < 1000; i++ {
+		_, err = stack.Push([]byte("h"), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.SetRetention("queue", Retention{MaxDepth: 500})
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := stack.Push([]byte("h"), []byte(fmt.Sprint("n", i))); err != nil {
+				done <- err
+				return
+			}
+		}
+		for i := 0; i < 50; i++ {
+			if _, _, err := stack.Pop(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	dropped, err := db.Compact("queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if dropped < 500 {
+		t.Fatal("Too few dropped segments:", dropped)
+	}
+	check := func(stack interface {
+		IterateBackward(func(int, io.Reader, io.Reader) bool) error
+	}) []string {
+		var values []string
+		err := stack.IterateBackward(func(depth int, header io.Reader, body io.Reader) bool {
+			data, _ := ioutil.ReadAll(body)
+			values = append(values, string(data))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			if values[i] != fmt.Sprint("n", 49-i) {
+				t.Fatal("Bad value pushed during compaction at", i, values[i])
+			}
+		}
+		for i, value := range values[50:] {
+			if value != fmt.Sprint(999-i) {
+				t.Fatal("Bad value after compaction at", i, value)
+			}
+		}
+		return values
+	}
+	values := check(stack)
+	if len(values) != stack.Depth() {
+		t.Fatal("Depth is not matched to segments", len(values), stack.Depth())
+	}
+	// Reopen
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDatabase("./test-data/compactdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(check(db.Get("queue"))) != len(values) {
+		t.Fatal("Depth after reopen is not matched")
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRandomAccess(t *testing.T) {
+	db, err := NewDatabase("./test-data/accessdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i <= 100; i++ {
+		_, err = db.Get("history").Push([]byte(fmt.Sprint("h", i)), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, depth := range []int{1, 50, 100} {
+		header, data, err := db.At("history", depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(header) != fmt.Sprint("h", depth) || string(data) != fmt.Sprint(depth) {
+			t.Fatal("Bad message at", depth, string(header), string(data))
+		}
+	}
+	if _, _, err := db.At("history", 101); err != ErrOutOfRange {
+		t.Fatal("Out of range expected:", err)
+	}
+	if _, _, err := db.At("unknown", 1); err != ErrNotFound {
+		t.Fatal("Not found expected:", err)
+	}
+	segments, err := db.Range("history", 95, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 6 || segments[0].Depth != 95 || string(segments[5].Data) != "100" {
+		t.Fatal("Bad range:", segments)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	db, err := NewDatabase("./test-data/historydb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i <= 20; i++ {
+		_, err = db.Get("history").Push([]byte("h"), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := db.History("history", 2, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 || segments[0].Depth != 18 || string(segments[2].Data) != "16" {
+		t.Fatal("Bad descending history:", segments)
+	}
+	segments, err = db.History("history", 18, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[0].Depth != 19 || string(segments[1].Data) != "20" {
+		t.Fatal("Bad ascending history:", segments)
+	}
+	if db.Get("history").Depth() != 20 {
+		t.Fatal("History must not change stack")
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPopWait(t *testing.T) {
+	db, err := NewDatabase("./test-data/waitdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.PopWait("jobs", 50*time.Millisecond); err != ErrNotFound {
+		t.Fatal("Timeout expected:", err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		db.Push("jobs", []byte("h"), []byte("job"))
+	}()
+	started := time.Now()
+	segment, err := db.Sub("jobs").PopWait("", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(segment.Data) != "job" || segment.Depth != 1 {
+		t.Fatal("Bad message:", segment)
+	}
+	if time.Since(started) > 3*time.Second {
+		t.Fatal("Waiter must be notified by push")
+	}
+	if _, err := db.PopWait("jobs", 50*time.Millisecond); err != ErrEmpty {
+		t.Fatal("Timeout on empty stack expected:", err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db, err := NewDatabase("./test-data/watchdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	watcher := db.Sub("sensors").Watch("room1")
+	defer watcher.Close()
+	for _, key := range []string{"sensors/room1/temp", "sensors/room2/temp", "sensors/room10"} {
+		if _, err = db.Push(key, []byte("h"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = db.Pop("sensors/room1/temp"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Event{{Type: EventPush, Key: "room1/temp", Depth: 1}, {Type: EventPop, Key: "room1/temp", Depth: 0}}
+	for _, exp := range expected {
+		select {
+		case event := <-watcher.Events:
+			if event.Type != exp.Type || event.Key != exp.Key || event.Depth != exp.Depth {
+				t.Fatal("Unexpected event", event, "instead of", exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No event", exp)
+		}
+	}
+	watcher.Close()
+	if event, ok := <-watcher.Events; ok {
+		t.Fatal("Events must be closed, got", event)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	db, err := NewDatabase("./test-data/crcdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		_, err = db.Push("crc", []byte(fmt.Sprint("header-", i)), []byte(fmt.Sprint("payload-", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	// Flip bytes in body of second and third messages
+	content, err := ioutil.ReadFile("./test-data/crcdb/crc/#stack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"payload-2", "payload-3"} {
+		content[strings.Index(string(content), body)] ^= 0xFF
+	}
+	err = ioutil.WriteFile("./test-data/crcdb/crc/#stack", content, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabase("./test-data/crcdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bad, err := db.ScanVerify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 2 || bad[0].Key != "crc" || bad[0].Depth != 2 || bad[0].Part != "body" || bad[1].Depth != 3 {
+		t.Fatal("Bad blocks not detected:", bad)
+	}
+	if _, _, err := db.At("crc", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.At("crc", 2); err != ErrCorrupted {
+		t.Fatal("Corruption expected:", err)
+	}
+	if segments, err := db.Range("crc", 1, 3); err != ErrCorrupted || len(segments) != 3 || string(segments[0].Data) != "payload-1" {
+		t.Fatal("Corrupted messages expected in range:", len(segments), err)
+	}
+	if _, err := db.History("crc", 0, 10, false); err != ErrCorrupted {
+		t.Fatal("Corruption expected in history:", err)
+	}
+	// Ascending history doesn't repair stack file
+	if _, err := db.History("crc", 0, 10, true); err != ErrCorrupted {
+		t.Fatal("Corruption expected in ascending history:", err)
+	}
+	if after, _ := ioutil.ReadFile("./test-data/crcdb/crc/#stack"); !bytes.Equal(after, content) {
+		t.Fatal("Stack file is changed by history")
+	}
+	if segment, err := db.Peak("crc"); err != ErrCorrupted || string(segment.Header) != "header-3" {
+		t.Fatal("Corruption expected on peak:", err)
+	}
+	// Corrupted message is removed by pop
+	if _, err := db.Pop("crc"); err != ErrCorrupted {
+		t.Fatal("Corruption expected on pop:", err)
+	}
+	if depth := db.Get("crc").Depth(); depth != 2 {
+		t.Fatal("Corrupted message not removed, depth", depth)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Stack file of first version: no file header, blocks without checksums
+func legacyStack(messages ...string) []byte {
+	buffer := &bytes.Buffer{}
+	var prev uint64
+	for _, msg := range messages {
+		offset := uint64(buffer.Len())
+		binary.Write(buffer, binary.LittleEndian, []uint64{prev, offset + 40, 1, offset + 41, uint64(len(msg))})
+		buffer.WriteString("h" + msg)
+		prev = offset
+	}
+	return buffer.Bytes()
+}
+
+func TestFileFormat(t *testing.T) {
+	readme := []byte("This is not a stack")
+	os.MkdirAll("./test-data/formatdb", 0755)
+	if err := ioutil.WriteFile("./test-data/formatdb/README", readme, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("./test-data/formatdb/legacy", legacyStack("one", "two"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase("./test-data/formatdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if names := db.Names(); len(names) != 1 || names[0] != "legacy" {
+		t.Fatal("Only legacy stack expected:", names)
+	}
+	if _, err = db.Peak("README"); err != ErrNotStack {
+		t.Fatal("Not a stack expected:", err)
+	}
+	os.MkdirAll("./test-data/formatdb/text", 0755)
+	if err := ioutil.WriteFile("./test-data/formatdb/text/#stack", readme, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Push("text", []byte("h"), []byte("data")); err != ErrNotStack {
+		t.Fatal("Not a stack expected:", err)
+	}
+	if content, _ := ioutil.ReadFile("./test-data/formatdb/text/#stack"); !bytes.Equal(content, readme) {
+		t.Fatal("Not a stack file was changed:", string(content))
+	}
+	if content, _ := ioutil.ReadFile("./test-data/formatdb/README"); !bytes.Equal(content, readme) {
+		t.Fatal("Not a stack file was changed:", string(content))
+	}
+	if segment, err := db.Peak("legacy"); err != nil || string(segment.Data) != "two" || segment.Depth != 2 {
+		t.Fatal("Bad legacy stack:", segment, err)
+	}
+	if _, err = db.Push("legacy", []byte("h"), []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err = filestack.Migrate("./test-data/formatdb/README"); err != filestack.ErrNotStack {
+		t.Fatal("Not a stack expected:", err)
+	}
+	if ok, err := filestack.Migrate("./test-data/formatdb/legacy/#stack"); !ok || err != nil {
+		t.Fatal("Legacy stack not migrated:", err)
+	}
+	if ok, err := filestack.Migrate("./test-data/formatdb/legacy/#stack"); ok || err != nil {
+		t.Fatal("Migrated stack must be skipped:", err)
+	}
+	content, _ := ioutil.ReadFile("./test-data/formatdb/legacy/#stack")
+	if !strings.HasPrefix(string(content), "FSTK") {
+		t.Fatal("No file header after migration")
+	}
+
+	db, err = NewDatabase("./test-data/formatdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bad, err := db.ScanVerify()
+	if err != nil || len(bad) != 0 {
+		t.Fatal("Migrated stack is not valid:", bad, err)
+	}
+	segments, err := db.History("legacy", 0, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 || string(segments[0].Data) != "one" || string(segments[2].Data) != "three" {
+		t.Fatal("Bad history after migration:", segments)
+	}
+	if _, err = db.Pop("legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Clean(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	if mode, err := ParseSyncMode("interval"); err != nil || mode != SyncInterval {
+		t.Fatal("Bad sync mode:", mode, err)
+	}
+	if _, err := ParseSyncMode("sometimes"); err != ErrUnknownSyncMode {
+		t.Fatal("Unknown mode expected:", err)
+	}
+	db, err := NewDatabase("./test-data/syncdb", 3*time.Second, Durability(SyncInterval, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Push("sensors", []byte("h"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	db.syncLock.Lock()
+	dirty := len(db.dirty)
+	db.syncLock.Unlock()
+	if dirty != 1 {
+		t.Fatal("Pushed stack must wait for group commit")
+	}
+	time.Sleep(100 * time.Millisecond)
+	db.syncLock.Lock()
+	dirty = len(db.dirty)
+	db.syncLock.Unlock()
+	if dirty != 0 {
+		t.Fatal("Stack is not synced by group commit")
+	}
+	// Batch is committed without fsync and synced by group commit with removal of its journal
+	if _, err = db.PushBatch([]Message{{Key: "sensors", Data: []byte("2")}, {Key: "meters", Data: []byte("1")}}); err != nil {
+		t.Fatal(err)
+	}
+	db.syncLock.Lock()
+	dirty, dirtyRoot := len(db.dirty), db.dirtyRoot
+	db.syncLock.Unlock()
+	if dirty != 2 || !dirtyRoot {
+		t.Fatal("Batch must wait for group commit:", dirty, dirtyRoot)
+	}
+	time.Sleep(100 * time.Millisecond)
+	db.syncLock.Lock()
+	dirty, dirtyRoot = len(db.dirty), db.dirtyRoot
+	db.syncLock.Unlock()
+	if dirty != 0 || dirtyRoot {
+		t.Fatal("Batch is not synced by group commit")
+	}
+	// Removed stack is not recreated by group commit
+	if _, err = db.Push("sensors/room1", []byte("h"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Remove("sensors/room1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err = os.Stat("./test-data/syncdb/sensors/room1"); !os.IsNotExist(err) {
+		t.Fatal("Removed stack is recreated:", err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files and directories of new sub-section are created and synced before push
+	db, err = NewDatabase("./test-data/syncdb", 3*time.Second, Durability(SyncAlways, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Push("sensors/room1/temp", []byte("h"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat("./test-data/syncdb/sensors/room1/temp/" + StackFile + filestack.IndexSuffix); err != nil {
+		t.Fatal("Index of new stack is not created:", err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupCommitOpenFiles(t *testing.T) {
+	db, err := NewDatabase("./test-data/syncpooldb", 3*time.Second, MaxOpenFiles(4), Durability(SyncInterval, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fds, _ := ioutil.ReadDir("/proc/self/fd")
+	opened := len(fds)
+	for i := 0; i < 100; i++ {
+		if _, err = db.Push(fmt.Sprintf("key-%v", i), []byte("h"), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Evicted stacks are synced by close, so only opened stacks are synced by group commit
+	time.Sleep(100 * time.Millisecond)
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil && len(fds)-opened > 4 {
+		t.Fatal("Too many opened files after group commit:", len(fds)-opened)
+	}
+	db.syncLock.Lock()
+	dirty := len(db.dirty)
+	db.syncLock.Unlock()
+	if dirty != 0 {
+		t.Fatal("Stacks are not synced:", dirty)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushBatch(t *testing.T) {
+	db, err := NewDatabase("./test-data/batchdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Push("a", []byte("h"), []byte("a1")); err != nil {
+		t.Fatal(err)
+	}
+	depths, err := db.PushBatch([]Message{
+		{Key: "a", Header: []byte("h"), Data: []byte("a2")},
+		{Key: "b", Header: []byte("h"), Data: []byte("b1")},
+		{Key: "a", Header: []byte("h"), Data: []byte("a3")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(depths) != 3 || depths[0] != 2 || depths[1] != 1 || depths[2] != 3 {
+		t.Fatal("Bad depth indexes:", depths)
+	}
+	segments, err := db.History("a", 0, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 || string(segments[1].Data) != "a2" || string(segments[2].Data) != "a3" {
+		t.Fatal("Bad history after batch:", segments)
+	}
+	if _, err = db.PushBatch([]Message{{Key: "/", Data: []byte("x")}}); err != ErrInvalidKey {
+		t.Fatal("Invalid key expected:", err)
+	}
+	// Batch is not pushed partially if one of stacks fails
+	if err = ioutil.WriteFile("./test-data/batchdb/notes", []byte("This is not a stack"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test-data/batchdb/notes")
+	if _, err = db.PushBatch([]Message{{Key: "a", Data: []byte("a4")}, {Key: "notes", Data: []byte("x")}}); err != ErrNotStack {
+		t.Fatal("Not a stack expected:", err)
+	}
+	if depth := db.Get("a").Depth(); depth != 3 {
+		t.Fatal("Batch is pushed partially:", depth)
+	}
+	// Stack must be consistent after reopening
+	db.Close()
+	db, err = NewDatabase("./test-data/batchdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if segment, err := db.Peak("a"); err != nil || segment.Depth != 3 || string(segment.Data) != "a3" {
+		t.Fatal("Bad stack after reopen:", segment, err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	db, err := NewDatabase("./test-data/txdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Push("inbox", []byte("h"), []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	tx := db.Begin()
+	tx.Push("orders/123", []byte("h"), []byte("order"))
+	tx.Push("audit/orders", []byte("h"), []byte("audit"))
+	tx.Pop("inbox")
+	results, err := tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Depth != 1 || results[2].Depth != 1 || string(results[2].Data) != "first" {
+		t.Fatal("Bad transaction results:", results)
+	}
+	if _, err = tx.Commit(); err != ErrTxDone {
+		t.Fatal("Finished transaction expected:", err)
+	}
+	if db.Get("inbox").Depth() != 0 || db.Get("audit/orders").Depth() != 1 {
+		t.Fatal("Transaction is not applied")
+	}
+	// All or nothing
+	tx = db.Begin()
+	tx.Push("orders/123", []byte("h"), []byte("lost"))
+	tx.Push("orders/456", []byte("h"), []byte("lost"))
+	tx.Pop("inbox")
+	if _, err = tx.Commit(); err != ErrEmpty {
+		t.Fatal("Empty stack expected:", err)
+	}
+	if db.Get("orders/123").Depth() != 1 {
+		t.Fatal("Failed transaction is applied")
+	}
+	if _, err = os.Stat("./test-data/txdb/orders/456"); !os.IsNotExist(err) {
+		t.Fatal("Failed transaction created stack:", err)
+	}
+	// Interrupted transaction is undone by scan
+	if _, err = db.Push("inbox", []byte("h"), []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	s := db.Get("inbox")
+	cp, err := s.Checkpoint(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.writeJournal(txJournal{Stacks: []txCheckpoint{{Key: "inbox", Checkpoint: cp}, {Key: "outbox/new", New: true}}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Push("outbox/new", []byte("h"), []byte("garbage"))
+	s.Pop()
+	s.Push([]byte("h"), []byte("garbage"))
+	s.Push([]byte("h"), []byte("garbage"))
+	db.Close()
+
+	db, err = NewDatabase("./test-data/txdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if segment, err := db.Peak("inbox"); err != nil || segment.Depth != 1 || string(segment.Data) != "second" {
+		t.Fatal("Interrupted transaction is not undone:", segment, err)
+	}
+	if _, err = os.Stat("./test-data/txdb/outbox"); !os.IsNotExist(err) {
+		t.Fatal("Stack created by interrupted transaction is not removed:", err)
+	}
+	if journals, _ := filepath.Glob("./test-data/txdb/#tx-*"); len(journals) != 0 {
+		t.Fatal("Journal is not removed:", journals)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	db, err := NewDatabase("./test-data/movedb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, msg := range []string{"job1", "job2"} {
+		if _, err = db.Push("inbox", []byte("h"), []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	watcher := db.Watch("")
+	defer watcher.Close()
+	segment, err := db.Move("inbox", "processing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment.Depth != 1 || string(segment.Data) != "job2" {
+		t.Fatal("Bad moved message:", segment)
+	}
+	if db.Get("inbox").Depth() != 1 || db.Get("processing").Depth() != 1 {
+		t.Fatal("Message is not moved")
+	}
+	for _, expected := range []Event{{Type: EventPop, Key: "inbox", Depth: 1}, {Type: EventPush, Key: "processing", Depth: 1}} {
+		event := <-watcher.Events
+		if event.Type != expected.Type || event.Key != expected.Key || event.Depth != expected.Depth {
+			t.Fatal("Bad event:", event)
+		}
+	}
+	if _, err = db.Move("processing", "processing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Move("unknown", "processing"); err != ErrNotFound {
+		t.Fatal("Not found expected:", err)
+	}
+	db.Pop("inbox")
+	if _, err = db.Move("inbox", "processing"); err != ErrEmpty {
+		t.Fatal("Empty stack expected:", err)
+	}
+	if db.Get("processing").Depth() != 1 {
+		t.Fatal("Failed move changed destination")
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShift(t *testing.T) {
+	db, err := NewDatabase("./test-data/shiftdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Unshift("list", []byte("h"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Push("list", []byte("h"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if depth, err := db.Unshift("list", []byte("h"), []byte("a")); err != nil || depth != 3 {
+		t.Fatal("Bad unshift:", depth, err)
+	}
+	segments, err := db.History("list", 0, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 || string(segments[0].Data) != "a" || string(segments[1].Data) != "b" || string(segments[2].Data) != "c" {
+		t.Fatal("Bad order after unshift:", segments)
+	}
+	segment, err := db.Shift("list")
+	if err != nil || string(segment.Data) != "a" || segment.Depth != 1 {
+		t.Fatal("Bad shift:", segment, err)
+	}
+	if segment, err = db.Peak("list"); err != nil || string(segment.Data) != "c" || segment.Depth != 2 {
+		t.Fatal("Bad last message after shift:", segment, err)
+	}
+	db.Shift("list")
+	db.Shift("list")
+	if _, err = db.Shift("list"); err != ErrEmpty {
+		t.Fatal("Empty stack expected:", err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	db, err := NewDatabase("./test-data/statdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Stat("missing"); err != ErrNotFound {
+		t.Fatal("Not found expected:", err)
+	}
+	started := time.Now()
+	db.Push("stat", []byte("h"), []byte("first"))
+	db.Push("stat", []byte("h"), []byte("second"))
+	stat, err := db.Stat("stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Depth != 2 || stat.Size <= int64(len("first")+len("second")) || stat.Format == 0 {
+		t.Fatal("Bad stat:", stat)
+	}
+	if stat.FirstPushed.Before(started.Add(-time.Second)) || stat.LastPushed.Before(stat.FirstPushed) || stat.LastAccess.IsZero() {
+		t.Fatal("Bad times:", stat)
+	}
+	db.Pop("stat")
+	db.Pop("stat")
+	if stat, err = db.Stat("stat"); err != nil || stat.Depth != 0 || stat.Size != 0 || !stat.LastPushed.IsZero() {
+		t.Fatal("Bad stat of empty stack:", stat, err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	db, err := NewDatabase("./test-data/metadb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Meta("jobs/a"); err != ErrNotFound {
+		t.Fatal("Not found expected:", err)
+	}
+	if err = db.SetMeta("jobs/a", "codec", "raw"); err != nil {
+		t.Fatal(err)
+	}
+	db.Push("jobs/a", []byte{0xff}, []byte("body"))
+	db.Close()
+
+	db, err = NewDatabase("./test-data/metadb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if names := db.Names(); len(names) != 1 {
+		t.Fatal("Metadata file is scanned as stack:", names)
+	}
+	meta, err := db.Sub("jobs").Meta("a")
+	if err != nil || meta["codec"] != "raw" {
+		t.Fatal("Bad metadata:", meta, err)
+	}
+	if err = db.SetMeta("jobs/a", "codec", ""); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ = db.Meta("jobs/a"); len(meta) != 0 {
+		t.Fatal("Value is not removed:", meta)
+	}
+	db.SetMeta("jobs/a", "codec", "raw")
+	if err = db.Remove("jobs/a"); err != nil {
+		t.Fatal(err)
+	}
+	db.Push("jobs/a", nil, []byte("body"))
+	if meta, err = db.Meta("jobs/a"); err != nil || len(meta) != 0 {
+		t.Fatal("Metadata of removed stack is kept:", meta, err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	db, err := NewDatabase("./test-data/streamdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+	if depth, err := db.PushFrom("files", []byte("known"), bytes.NewReader(payload), int64(len(payload))); err != nil || depth != 1 {
+		t.Fatal("Push with known size failed:", depth, err)
+	}
+	// Unknown size: read until EOF
+	if depth, err := db.PushFrom("files", []byte("unknown"), strings.NewReader("small"), -1); err != nil || depth != 2 {
+		t.Fatal("Push with unknown size failed:", depth, err)
+	}
+	// Short body is not pushed
+	if _, err = db.PushFrom("files", []byte("short"), strings.NewReader("abc"), 10); err != io.ErrUnexpectedEOF {
+		t.Fatal("Unexpected EOF expected:", err)
+	}
+	if segment, err := db.Peak("files"); err != nil || segment.Depth != 2 || string(segment.Data) != "small" {
+		t.Fatal("Failed push changed stack:", segment, err)
+	}
+	// Stalled body doesn't block the stack
+	reader, writer := io.Pipe()
+	pushed := make(chan error)
+	go func() {
+		_, err := db.PushFrom("files", []byte("slow"), reader, -1)
+		pushed <- err
+	}()
+	writer.Write([]byte("sl"))
+	if segment, err := db.Peak("files"); err != nil || segment.Depth != 2 {
+		t.Fatal("Stack is blocked by push:", segment, err)
+	}
+	writer.Write([]byte("ow"))
+	writer.Close()
+	if err = <-pushed; err != nil {
+		t.Fatal(err)
+	}
+	if segment, err := db.Pop("files"); err != nil || segment.Depth != 3 || string(segment.Data) != "slow" {
+		t.Fatal("Bad slow push:", segment, err)
+	}
+	if spools, _ := filepath.Glob("./test-data/streamdb/" + spoolPrefix + "*"); len(spools) != 0 {
+		t.Fatal("Temporary files are not removed:", spools)
+	}
+	if _, err = db.Open("none", 0); err != ErrNotFound {
+		t.Fatal("Not found expected:", err)
+	}
+	if _, err = db.Open("files", 3); err != ErrOutOfRange {
+		t.Fatal("Out of range expected:", err)
+	}
+	stream, err := db.Open("files", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stream.Header) != "known" || stream.Size != int64(len(payload)) || stream.Depth != 1 {
+		t.Fatal("Bad stream:", string(stream.Header), stream.Size, stream.Depth)
+	}
+	data, err := ioutil.ReadAll(stream)
+	stream.Close()
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatal("Bad streamed body:", len(data), err)
+	}
+	// Reader of removed message is cut
+	if stream, err = db.Open("files", 0); err != nil || stream.Depth != 2 {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	db.Pop("files")
+	if _, err = ioutil.ReadAll(stream); err != io.ErrUnexpectedEOF {
+		t.Fatal("Unexpected EOF of removed message expected:", err)
+	}
+	// Message is kept if handler fails
+	failed := fmt.Errorf("failed")
+	if err = db.PopStream("files", 0, func(stream *Stream) error { return failed }); err != failed {
+		t.Fatal("Handler error expected:", err)
+	}
+	err = db.PopStream("files", 0, func(stream *Stream) error {
+		data, err = ioutil.ReadAll(stream)
+		return err
+	})
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatal("Bad popped body:", len(data), err)
+	}
+	if err = db.PopStream("files", 50*time.Millisecond, func(stream *Stream) error { return nil }); err != ErrEmpty {
+		t.Fatal("Timeout on empty stack expected:", err)
+	}
+	// Stack is not locked while message is streamed: message covered by push is kept
+	db.Push("files", []byte("h"), []byte("first"))
+	err = db.PopStream("files", 0, func(stream *Stream) error {
+		_, err := db.Push("files", []byte("h"), []byte("second"))
+		return err
+	})
+	if err != ErrChanged {
+		t.Fatal("Changed stack expected:", err)
+	}
+	if _, data, err := db.At("files", 1); err != nil || string(data) != "first" {
+		t.Fatal("Streamed message should be kept:", string(data), err)
+	}
+	db.Pop("files")
+	db.Pop("files")
+
+	// Block of interrupted push (without meta-info) is removed on open
+	db.Push("files", []byte("h"), []byte("kept"))
+	db.Close()
+	file, err := os.OpenFile("./test-data/streamdb/files/#stack", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(make([]byte, 100))
+	file.Close()
+	db, err = NewDatabase("./test-data/streamdb", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Push("files", []byte("h"), []byte("next"))
+	if segment, err := db.Pop("files"); err != nil || segment.Depth != 2 || string(segment.Data) != "next" {
+		t.Fatal("Interrupted push is not repaired:", segment, err)
+	}
+	if segment, err := db.Pop("files"); err != nil || string(segment.Data) != "kept" {
+		t.Fatal("Interrupted push is not repaired:", segment, err)
+	}
+	err = db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
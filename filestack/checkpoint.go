@@ -0,0 +1,91 @@
+package filestack
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Checkpoint - saved top segments of stack. Stack file can be restored to state of checkpoint after any
+// pops and pushes which don't remove segments below Keep depth
+type Checkpoint struct {
+	Keep    int     // Number of first segments which are not saved
+	Offset  int64   // Location of first saved segment (end of kept segments)
+	Tail    []byte  // Content of saved segments
+	Offsets []int64 // Locations of saved segments
+	Times   []int64 // Push times of saved segments in unix nanoseconds
+}
+
+// LockCompaction - wait for running compaction and prevent new compactions until UnlockCompaction.
+// Locations of segments are not changed by compaction while it is locked
+func (s *Stack) LockCompaction() { s.compactGuard.Lock() }
+
+// UnlockCompaction - allow compaction locked by LockCompaction
+func (s *Stack) UnlockCompaction() { s.compactGuard.Unlock() }
+
+// Checkpoint - save segments above keep depth. Compaction has to be locked until checkpoint is not needed
+func (s *Stack) Checkpoint(keep int) (Checkpoint, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	var cp Checkpoint
+	if keep < 0 || keep > s.depth {
+		return cp, errors.New("checkpoint depth is out of stack")
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return cp, err
+	}
+	if len(segments) < s.depth {
+		return cp, errors.New("index of " + s.fileName + " is shorter then stack")
+	}
+	file, err := s.getFile()
+	if err != nil {
+		return cp, err
+	}
+	cp.Keep = keep
+	cp.Offset = s.currentBlock.NextBlockPoint()
+	if keep < s.depth {
+		cp.Offset = segments[keep].Offset
+	}
+	cp.Tail = make([]byte, s.currentBlock.NextBlockPoint()-cp.Offset)
+	if _, err = file.ReadAt(cp.Tail, cp.Offset); err != nil && err != io.EOF {
+		return cp, err
+	}
+	for _, segment := range segments[keep:] {
+		cp.Offsets = append(cp.Offsets, segment.Offset)
+		var pushed int64
+		if !segment.Pushed.IsZero() {
+			pushed = segment.Pushed.UnixNano()
+		}
+		cp.Times = append(cp.Times, pushed)
+	}
+	return cp, nil
+}
+
+// RestoreStack - restore closed stack file and index to state of checkpoint
+func RestoreStack(filename string, cp Checkpoint) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = file.Truncate(cp.Offset); err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(cp.Tail, cp.Offset); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	records := make([]indexRecord, len(cp.Offsets))
+	for i := range cp.Offsets {
+		records[i] = indexRecord{Offset: uint64(cp.Offsets[i]), Time: cp.Times[i]}
+	}
+	s := &Stack{fileName: filename}
+	defer s.Close()
+	if err = s.writeIndex(records, cp.Keep); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
@@ -0,0 +1,342 @@
+package filestack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Compact - rewrite stack to new file without first (oldest) drop segments and replace stack file.
+// Stack stays readable and writable during compaction: segments are copied without lock and only
+// segments changed during copying are copied again under lock before replacing. Returns number of dropped segments
+func (s *Stack) Compact(drop int) (int, error) {
+	s.compactGuard.Lock()
+	defer s.compactGuard.Unlock()
+	return s.compact(drop)
+}
+
+// Shift - remove first (oldest) segment. Stack file is rewritten online like by Compact.
+// Returns nil,nil,nil if stack is empty
+func (s *Stack) Shift() (header, data []byte, err error) {
+	s.compactGuard.Lock()
+	defer s.compactGuard.Unlock()
+	header, data, err = s.At(1)
+	if err != nil && err != ErrCorrupted {
+		return nil, nil, err
+	}
+	if header == nil || data == nil {
+		return nil, nil, nil
+	}
+	dropped, compactErr := s.compact(1)
+	if compactErr != nil {
+		return nil, nil, compactErr
+	}
+	if dropped == 0 {
+		// Segment was popped during compaction
+		return nil, nil, nil
+	}
+	return header, data, err
+}
+
+// Unshift - insert segment before first (oldest) segment. Stack file is rewritten under lock.
+// Returns new value of stack depth
+func (s *Stack) Unshift(header, data []byte) (int, error) {
+	s.compactGuard.Lock()
+	defer s.compactGuard.Unlock()
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	s.lastAccess = time.Now()
+	file, err := s.getFile()
+	if err != nil {
+		return -1, err
+	}
+	records, err := s.readIndex()
+	if err != nil {
+		return -1, err
+	}
+	if len(records) < s.depth {
+		return -1, errors.New("index of " + s.fileName + " is shorter then stack")
+	}
+	tmpName := s.fileName + TempSuffix
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		return -1, err
+	}
+	defer os.Remove(tmpName)
+	defer tmp.Close()
+	if err = writeHeader(tmp, s.format); err != nil {
+		return -1, err
+	}
+	// New head block refers to itself
+	bodyOffset := fileHeaderSize + blockSize(s.format)
+	block := fileBlock{
+		PrevBlock:   fileHeaderSize,
+		HeaderPoint: uint64(bodyOffset),
+		HeaderSize:  uint64(len(header)),
+		DataPoint:   uint64(bodyOffset) + uint64(len(header)),
+		DataSize:    uint64(len(data)),
+	}
+	if s.format != FormatV1 {
+		block.HeaderCRC = checksum(header)
+		block.DataCRC = checksum(data)
+	}
+	if err = block.writeTo(tmp, fileHeaderSize, s.format); err != nil {
+		return -1, err
+	}
+	if _, err = tmp.Write(header); err != nil {
+		return -1, err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return -1, err
+	}
+	kept := []indexRecord{{Offset: fileHeaderSize, Time: s.lastAccess.UnixNano()}}
+	tail, last, err := copyBlocks(tmp, block.NextBlockPoint(), file, records[:s.depth], s.currentBlock.NextBlockPoint(), fileHeaderSize, s.format)
+	if err != nil {
+		return -1, err
+	}
+	if len(tail) == 0 {
+		last = block
+	}
+	err = s.replaceFile(tmp, append(kept, tail...), last)
+	if err != nil {
+		return -1, err
+	}
+	return s.depth, nil
+}
+
+// Compaction under compaction lock
+func (s *Stack) compact(drop int) (int, error) {
+	// Snapshot of current state
+	s.guard.Lock()
+	records, err := s.readIndex()
+	if err != nil {
+		s.guard.Unlock()
+		return 0, err
+	}
+	if len(records) < s.depth {
+		s.guard.Unlock()
+		return 0, errors.New("index of " + s.fileName + " is shorter then stack")
+	}
+	depth := s.depth
+	end := s.currentBlock.NextBlockPoint()
+	if drop > depth {
+		drop = depth
+	}
+	if drop < 0 {
+		drop = 0
+	}
+	src, err := os.Open(s.fileName)
+	if err != nil {
+		s.guard.Unlock()
+		return 0, err
+	}
+	s.compacting = true
+	s.compactLow = depth
+	s.guard.Unlock()
+	defer func() {
+		s.guard.Lock()
+		s.compacting = false
+		s.guard.Unlock()
+	}()
+
+	tmpName := s.fileName + TempSuffix
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		src.Close()
+		return 0, err
+	}
+	defer os.Remove(tmpName)
+	defer tmp.Close()
+	// Compacted file always has header (old headerless files are upgraded)
+	err = writeHeader(tmp, s.format)
+	if err != nil {
+		src.Close()
+		return 0, err
+	}
+	// Copy without lock. Segments changed during copying are ignored later
+	kept, _, copyErr := copyBlocks(tmp, fileHeaderSize, src, records[drop:depth], end, -1, s.format)
+	src.Close()
+	return s.replaceCompacted(tmp, drop, kept, copyErr)
+}
+
+// Copy continuous blocks from source to destination file at specified offset and fix references.
+// Prev is location of block in destination before first copied block or -1 if first block is head.
+// Returns index records of successfully copied blocks and last copied block
+func copyBlocks(dst *os.File, dstOffset int64, src io.ReaderAt, records []indexRecord, end int64, prev int64, format int) ([]indexRecord, fileBlock, error) {
+	var block fileBlock
+	if len(records) == 0 {
+		return nil, block, nil
+	}
+	srcOffset := int64(records[0].Offset)
+	shift := srcOffset - dstOffset
+	_, err := dst.Seek(dstOffset, os.SEEK_SET)
+	if err != nil {
+		return nil, block, err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(src, srcOffset, end-srcOffset))
+	if err != nil {
+		return nil, block, err
+	}
+	copied := make([]indexRecord, 0, len(records))
+	for i, record := range records {
+		offset := int64(record.Offset) - shift
+		b, err := readBlockAt(dst, offset, format)
+		if err != nil {
+			return copied, block, err
+		}
+		if b.corrupted {
+			// Rewriting of damaged meta-info would hide corruption
+			return copied, block, ErrCorrupted
+		}
+		if i != 0 {
+			b.PrevBlock = uint64(int64(b.PrevBlock) - shift)
+		} else if prev < 0 {
+			b.PrevBlock = uint64(offset) // Head block refers to itself
+		} else {
+			b.PrevBlock = uint64(prev)
+		}
+		b.HeaderPoint = uint64(int64(b.HeaderPoint) - shift)
+		b.DataPoint = uint64(int64(b.DataPoint) - shift)
+		err = b.writeTo(dst, offset, format)
+		if err != nil {
+			return copied, block, err
+		}
+		copied = append(copied, indexRecord{Offset: uint64(offset), Time: record.Time})
+		block = b
+	}
+	return copied, block, nil
+}
+
+// Copy segments changed during compaction and replace stack file by compacted file
+func (s *Stack) replaceCompacted(tmp *os.File, drop int, kept []indexRecord, copyErr error) (int, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	// Segments below minimal depth were not changed during copying
+	low := s.compactLow
+	valid := low - drop
+	if valid < 0 {
+		valid = 0
+		drop = low
+	}
+	if valid > len(kept) {
+		if copyErr == nil {
+			copyErr = errors.New("compacted copy of " + s.fileName + " is incomplete")
+		}
+		return 0, copyErr
+	}
+	kept = kept[:valid]
+	file, err := s.getFile()
+	if err != nil {
+		return 0, err
+	}
+	records, err := s.readIndex()
+	if err != nil {
+		return 0, err
+	}
+	if len(records) < s.depth {
+		return 0, errors.New("index of " + s.fileName + " is shorter then stack")
+	}
+	var (
+		last    fileBlock
+		tmpEnd  int64 = fileHeaderSize
+		prevPos int64 = -1
+	)
+	if len(kept) > 0 {
+		prevPos = int64(kept[len(kept)-1].Offset)
+		last, err = readBlockAt(tmp, prevPos, s.format)
+		if err != nil {
+			return 0, err
+		}
+		tmpEnd = last.NextBlockPoint()
+	}
+	err = tmp.Truncate(tmpEnd)
+	if err != nil {
+		return 0, err
+	}
+	// Copy segments pushed during compaction
+	tail, tailBlock, err := copyBlocks(tmp, tmpEnd, file, records[low:s.depth], s.currentBlock.NextBlockPoint(), prevPos, s.format)
+	if err != nil {
+		return 0, err
+	}
+	if len(tail) > 0 {
+		last = tailBlock
+	}
+	kept = append(kept, tail...)
+	err = s.replaceFile(tmp, kept, last)
+	if err != nil {
+		return 0, err
+	}
+	return drop, nil
+}
+
+// Replace stack file by new file with header and segments at specified locations. Last is meta-info of last segment
+func (s *Stack) replaceFile(tmp *os.File, records []indexRecord, last fileBlock) error {
+	err := tmp.Sync()
+	if err != nil {
+		return err
+	}
+	// Prepare new index
+	indexName := s.fileName + IndexSuffix
+	tmpIndexName := indexName + TempSuffix
+	buffer := &bytes.Buffer{}
+	err = binary.Write(buffer, binary.LittleEndian, records)
+	if err != nil {
+		return err
+	}
+	err = writeFile(tmpIndexName, buffer.Bytes())
+	if err != nil {
+		os.Remove(tmpIndexName)
+		return err
+	}
+	// Replace files. Not matched index will be rebuilt on next open
+	if s.index != nil {
+		s.index.Close()
+		s.index = nil
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	err = os.Rename(tmp.Name(), s.fileName)
+	if err != nil {
+		os.Remove(tmpIndexName)
+		return err
+	}
+	err = os.Rename(tmpIndexName, indexName)
+	if err != nil {
+		return err
+	}
+	s.dataStart = fileHeaderSize
+	// Last segment is changed only if stack becomes empty or first segment is inserted to empty stack
+	if len(records) == 0 || s.depth == 0 {
+		s.revision++
+	}
+	s.depth = len(records)
+	s.currentBlock = last
+	s.currentBlockPos = fileHeaderSize
+	if len(records) > 0 {
+		s.currentBlockPos = int64(records[len(records)-1].Offset)
+	} else {
+		s.currentBlock = s.emptyBlock()
+	}
+	return nil
+}
+
+// Write and sync file
+func writeFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,340 @@
+package filestack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Formats of blocks in stack file
+const (
+	FormatV1 = 1 // Blocks without checksums
+	FormatV2 = 2 // Blocks with signature and CRC32C checksums of meta-info, header and body
+)
+
+// Signature of each block in format 2 ("FSB2")
+const blockSignature uint32 = 0x32425346
+
+// ErrCorrupted - checksum of segment is not matched to content
+var ErrCorrupted = errors.New("segment is corrupted: checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Meta-info of block in format 1
+type blockV1 struct {
+	PrevBlock   uint64
+	HeaderPoint uint64
+	HeaderSize  uint64
+	DataPoint   uint64
+	DataSize    uint64
+}
+
+// Meta-info of block in format 2
+type blockV2 struct {
+	Signature   uint32
+	MetaCRC     uint32 // Checksum of rest fields
+	PrevBlock   uint64
+	HeaderPoint uint64
+	HeaderSize  uint64
+	DataPoint   uint64
+	DataSize    uint64
+	HeaderCRC   uint32
+	DataCRC     uint32
+}
+
+// Size of block meta-info in file
+func blockSize(format int) int64 {
+	if format == FormatV1 {
+		return 8 + 8 + 8 + 8 + 8
+	}
+	return 4 + 4 + 8 + 8 + 8 + 8 + 8 + 4 + 4
+}
+
+func checksum(data []byte) uint32 { return crc32.Checksum(data, crcTable) }
+
+// Checksum of meta-info fields
+func (fb *fileBlock) metaChecksum() uint32 {
+	buffer := &bytes.Buffer{}
+	binary.Write(buffer, binary.LittleEndian, []interface{}{fb.PrevBlock, fb.HeaderPoint, fb.HeaderSize,
+		fb.DataPoint, fb.DataSize, fb.HeaderCRC, fb.DataCRC})
+	return checksum(buffer.Bytes())
+}
+
+// Read meta-info at specified place. Meta-info in format 2 with wrong signature or checksum is marked as corrupted
+func readBlockAt(reader io.ReadSeeker, offset int64, format int) (fileBlock, error) {
+	var block fileBlock
+	_, err := reader.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		return block, err
+	}
+	if format == FormatV1 {
+		var v1 blockV1
+		err = binary.Read(reader, binary.LittleEndian, &v1)
+		block = fileBlock{PrevBlock: v1.PrevBlock, HeaderPoint: v1.HeaderPoint, HeaderSize: v1.HeaderSize,
+			DataPoint: v1.DataPoint, DataSize: v1.DataSize}
+		return block, err
+	}
+	var v2 blockV2
+	err = binary.Read(reader, binary.LittleEndian, &v2)
+	block = fileBlock{PrevBlock: v2.PrevBlock, HeaderPoint: v2.HeaderPoint, HeaderSize: v2.HeaderSize,
+		DataPoint: v2.DataPoint, DataSize: v2.DataSize, HeaderCRC: v2.HeaderCRC, DataCRC: v2.DataCRC}
+	block.corrupted = v2.Signature != blockSignature || v2.MetaCRC != block.metaChecksum()
+	return block, err
+}
+
+// Write meta-info to specified place
+func (fb *fileBlock) writeTo(writer io.WriteSeeker, offset int64, format int) error {
+	_, err := writer.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	return fb.write(writer, format)
+}
+
+// Write meta-info to current place
+func (fb *fileBlock) write(writer io.Writer, format int) error {
+	if format == FormatV1 {
+		return binary.Write(writer, binary.LittleEndian, blockV1{PrevBlock: fb.PrevBlock, HeaderPoint: fb.HeaderPoint,
+			HeaderSize: fb.HeaderSize, DataPoint: fb.DataPoint, DataSize: fb.DataSize})
+	}
+	fb.corrupted = false
+	return binary.Write(writer, binary.LittleEndian, blockV2{Signature: blockSignature, MetaCRC: fb.metaChecksum(),
+		PrevBlock: fb.PrevBlock, HeaderPoint: fb.HeaderPoint, HeaderSize: fb.HeaderSize, DataPoint: fb.DataPoint,
+		DataSize: fb.DataSize, HeaderCRC: fb.HeaderCRC, DataCRC: fb.DataCRC})
+}
+
+// File header: magic and version (format of blocks)
+type fileHeader struct {
+	Magic   [4]byte
+	Version uint32
+}
+
+// Magic bytes at begining of stack file
+const fileMagic = "FSTK"
+
+const fileHeaderSize = 4 + 4
+
+// CurrentFormat - format of new stack files
+const CurrentFormat = FormatV2
+
+// Errors of file format
+var (
+	ErrNotStack           = errors.New("file is not a stack")
+	ErrUnsupportedVersion = errors.New("unsupported version of stack file")
+)
+
+// Write file header at begining of file
+func writeHeader(file io.WriterAt, format int) error {
+	header := fileHeader{Version: uint32(format)}
+	copy(header.Magic[:], fileMagic)
+	buffer := &bytes.Buffer{}
+	err := binary.Write(buffer, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(buffer.Bytes(), 0)
+	return err
+}
+
+// Read format from file header. Files without header (old files) have format 1 or signature of format 2
+// at begining. Headerless is true for old files
+func readFormat(file io.ReaderAt) (format int, headerless bool, err error) {
+	var data [fileHeaderSize]byte
+	n, err := file.ReadAt(data[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	if n >= len(fileMagic) && string(data[:len(fileMagic)]) == fileMagic {
+		if n < fileHeaderSize {
+			return 0, false, ErrNotStack
+		}
+		version := binary.LittleEndian.Uint32(data[len(fileMagic):])
+		if version < FormatV1 || version > CurrentFormat {
+			return 0, false, ErrUnsupportedVersion
+		}
+		return int(version), false, nil
+	}
+	if n >= 4 && binary.LittleEndian.Uint32(data[:4]) == blockSignature {
+		return FormatV2, true, nil
+	}
+	return FormatV1, true, nil
+}
+
+// Detect format of stack file and location of first block. Header is written to new (empty) files.
+// Returns ErrNotStack if file is not a stack
+func detectFormat(file *os.File) (int, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.Size() == 0 {
+		return CurrentFormat, fileHeaderSize, writeHeader(file, CurrentFormat)
+	}
+	format, headerless, err := readFormat(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	if headerless {
+		// Files of other applications are not repaired (truncated) as old stacks
+		return format, 0, validateBlocks(file, info.Size(), format)
+	}
+	return format, fileHeaderSize, nil
+}
+
+// CheckFile - check that file is a stack. Files with header are checked by magic and version,
+// all blocks of old files without header have to be consistent (except incomplete last block).
+// Returns ErrNotStack for other files. Empty file is treated as empty stack
+func CheckFile(filename string) (format int, headerless bool, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	if info.Size() == 0 {
+		return CurrentFormat, false, nil
+	}
+	format, headerless, err = readFormat(file)
+	if err != nil || !headerless {
+		return format, headerless, err
+	}
+	return format, headerless, validateBlocks(file, info.Size(), format)
+}
+
+// Check references and sizes of all blocks in headerless file
+func validateBlocks(file io.ReaderAt, size int64, format int) error {
+	reader := io.NewSectionReader(file, 0, size)
+	var offset, prev int64
+	for offset < size {
+		if size-offset < blockSize(format) && offset > 0 {
+			// Incomplete meta-info after last block is truncated by repair
+			break
+		}
+		block, err := readBlockAt(reader, offset, format)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrNotStack
+		}
+		if err != nil {
+			return err
+		}
+		if block.corrupted || block.PrevBlock != uint64(prev) || block.HeaderPoint != uint64(offset+blockSize(format)) ||
+			block.HeaderSize > uint64(size) || block.DataSize > uint64(size) ||
+			block.DataPoint != block.HeaderPoint+block.HeaderSize {
+			return ErrNotStack
+		}
+		if block.NextBlockPoint() > size {
+			// Content of last block is not completely written: block is truncated by repair
+			break
+		}
+		prev = offset
+		offset = block.NextBlockPoint()
+	}
+	return nil
+}
+
+// Format of blocks in stack file
+func (s *Stack) Format() int { return s.format }
+
+// Check content of segment against checksums
+func (s *Stack) verifySegment(block fileBlock, header, data []byte) error {
+	if s.format == FormatV1 {
+		return nil
+	}
+	if block.corrupted || checksum(header) != block.HeaderCRC || checksum(data) != block.DataCRC {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// Reader which checks checksum of content at the end of reading
+type crcReader struct {
+	reader    io.Reader
+	hash      hash.Hash32
+	expected  uint32
+	corrupted bool
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	if cr.corrupted {
+		return 0, ErrCorrupted
+	}
+	n, err := cr.reader.Read(p)
+	cr.hash.Write(p[:n])
+	if err == io.EOF && cr.hash.Sum32() != cr.expected {
+		return n, ErrCorrupted
+	}
+	return n, err
+}
+
+// Readers of segment header and body. Readers of format 2 return ErrCorrupted at the end if checksum is not matched
+func (s *Stack) segmentReaders(file *os.File, block fileBlock) (header io.Reader, body io.Reader) {
+	header = io.NewSectionReader(file, int64(block.HeaderPoint), int64(block.HeaderSize))
+	body = &cutReader{reader: io.NewSectionReader(file, int64(block.DataPoint), int64(block.DataSize)), remaining: int64(block.DataSize)}
+	if s.format == FormatV1 {
+		return header, body
+	}
+	header = &crcReader{reader: header, hash: crc32.New(crcTable), expected: block.HeaderCRC, corrupted: block.corrupted}
+	body = &crcReader{reader: body, hash: crc32.New(crcTable), expected: block.DataCRC, corrupted: block.corrupted}
+	return header, body
+}
+
+// Corruption - damaged part of segment
+type Corruption struct {
+	Depth  int    // Depth index of segment
+	Offset int64  // Location of segment meta-info in stack file
+	Part   string // Damaged part: meta, header or body
+}
+
+// Verify - check checksums of all segments. Returns list of damaged parts. Stacks in format 1 have no checksums
+func (s *Stack) Verify() ([]Corruption, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if s.format == FormatV1 {
+		return nil, nil
+	}
+	file, err := s.getFile()
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > s.depth {
+		records = records[:s.depth]
+	}
+	var corruptions []Corruption
+	for i, record := range records {
+		block, err := readBlockAt(file, int64(record.Offset), s.format)
+		if err != nil {
+			return corruptions, err
+		}
+		if block.corrupted {
+			corruptions = append(corruptions, Corruption{Depth: i + 1, Offset: int64(record.Offset), Part: "meta"})
+			continue
+		}
+		for _, part := range []struct {
+			name     string
+			offset   uint64
+			size     uint64
+			expected uint32
+		}{{"header", block.HeaderPoint, block.HeaderSize, block.HeaderCRC}, {"body", block.DataPoint, block.DataSize, block.DataCRC}} {
+			hash := crc32.New(crcTable)
+			_, err = io.Copy(hash, io.NewSectionReader(file, int64(part.offset), int64(part.size)))
+			if err != nil {
+				return corruptions, err
+			}
+			if hash.Sum32() != part.expected {
+				corruptions = append(corruptions, Corruption{Depth: i + 1, Offset: int64(record.Offset), Part: part.name})
+			}
+		}
+	}
+	return corruptions, nil
+}
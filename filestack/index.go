@@ -0,0 +1,140 @@
+package filestack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// IndexSuffix - suffix of index file name. Index file is placed near stack file and keeps
+// location and push time of each segment. Index can be rebuilt from stack file (except push time)
+const IndexSuffix = "#index"
+
+// One record in index file per segment
+type indexRecord struct {
+	Offset uint64 // Location of segment meta-info in stack file
+	Time   int64  // Push time in unix nanoseconds. Zero if unknown
+}
+
+const indexRecordSize = 8 + 8
+
+// SegmentInfo - location and push time of segment
+type SegmentInfo struct {
+	Depth  int       // Depth index of segment (1 - first pushed segment)
+	Offset int64     // Location of segment in stack file
+	Size   int64     // Size of segment in stack file including meta-info
+	Pushed time.Time // Push time. Zero if unknown (segment pushed before index was created)
+}
+
+func (s *Stack) getIndex() (*os.File, error) {
+	if s.index == nil {
+		f, err := os.OpenFile(s.fileName+IndexSuffix, os.O_CREATE|os.O_RDWR, 0755)
+		if err != nil {
+			return nil, err
+		}
+		s.index = f
+	}
+	return s.index, nil
+}
+
+// Read all records from index file
+func (s *Stack) readIndex() ([]indexRecord, error) {
+	index, err := s.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(index, 0, 1<<62))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]indexRecord, len(data)/indexRecordSize)
+	err = binary.Read(bytes.NewReader(data[:len(records)*indexRecordSize]), binary.LittleEndian, records)
+	return records, err
+}
+
+// Read one index record by position (0 - first segment)
+func (s *Stack) readIndexRecord(pos int) (indexRecord, error) {
+	var record indexRecord
+	index, err := s.getIndex()
+	if err != nil {
+		return record, err
+	}
+	err = binary.Read(io.NewSectionReader(index, int64(pos)*indexRecordSize, indexRecordSize), binary.LittleEndian, &record)
+	return record, err
+}
+
+// Write index records starting from specified depth (0 - first) and truncate rest of index
+func (s *Stack) writeIndex(records []indexRecord, from int) error {
+	index, err := s.getIndex()
+	if err != nil {
+		return err
+	}
+	buffer := &bytes.Buffer{}
+	err = binary.Write(buffer, binary.LittleEndian, records)
+	if err != nil {
+		return err
+	}
+	_, err = index.WriteAt(buffer.Bytes(), int64(from)*indexRecordSize)
+	if err != nil {
+		return err
+	}
+	return index.Truncate(int64(from+len(records)) * indexRecordSize)
+}
+
+// Check index against actual segments locations. Records with wrong locations are rebuilt
+func (s *Stack) checkIndex(offsets []uint64) error {
+	records, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+	valid := len(records) >= len(offsets)
+	fixed := make([]indexRecord, len(offsets))
+	for i, offset := range offsets {
+		fixed[i].Offset = offset
+		if i < len(records) && records[i].Offset == offset {
+			fixed[i].Time = records[i].Time
+		} else {
+			valid = false
+		}
+	}
+	if valid && len(records) == len(offsets) {
+		return nil
+	}
+	if !valid {
+		log.Println("Index of", s.fileName, "is not matched to stack", "!rebuild!")
+	}
+	return s.writeIndex(fixed, 0)
+}
+
+// Segments - location, size and push time of all segments from first to last
+func (s *Stack) Segments() ([]SegmentInfo, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return s.segments()
+}
+
+func (s *Stack) segments() ([]SegmentInfo, error) {
+	records, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > s.depth {
+		records = records[:s.depth]
+	}
+	infos := make([]SegmentInfo, len(records))
+	end := s.currentBlock.NextBlockPoint()
+	for i := len(records) - 1; i >= 0; i-- {
+		infos[i].Depth = i + 1
+		infos[i].Offset = int64(records[i].Offset)
+		infos[i].Size = end - infos[i].Offset
+		if records[i].Time != 0 {
+			infos[i].Pushed = time.Unix(0, records[i].Time)
+		}
+		end = infos[i].Offset
+	}
+	return infos, nil
+}
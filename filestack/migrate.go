@@ -0,0 +1,108 @@
+package filestack
+
+import (
+	"errors"
+	"os"
+)
+
+// Migrate - upgrade stack file to current format in place: add file header and checksums of segments.
+// Push times of segments are kept. Returns false if file already has current format and ErrNotStack
+// if file is not a stack. File must not be used by other process during migration
+func Migrate(filename string) (bool, error) {
+	format, headerless, err := CheckFile(filename)
+	if err != nil {
+		return false, err
+	}
+	if !headerless && format == CurrentFormat {
+		return false, nil
+	}
+	s, err := OpenStack(filename)
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+	return true, s.upgrade()
+}
+
+// Rewrite all segments to new file of current format and replace stack file
+func (s *Stack) upgrade() error {
+	s.compactGuard.Lock()
+	defer s.compactGuard.Unlock()
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	file, err := s.getFile()
+	if err != nil {
+		return err
+	}
+	records, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+	if len(records) < s.depth {
+		return errors.New("index of " + s.fileName + " is shorter then stack")
+	}
+	tmpName := s.fileName + TempSuffix
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	defer tmp.Close()
+	err = writeHeader(tmp, CurrentFormat)
+	if err != nil {
+		return err
+	}
+	var (
+		last     fileBlock
+		offset   int64 = fileHeaderSize
+		upgraded       = make([]indexRecord, 0, s.depth)
+	)
+	for _, record := range records[:s.depth] {
+		block, err := readBlockAt(file, int64(record.Offset), s.format)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, block.HeaderSize)
+		data := make([]byte, block.DataSize)
+		if _, err = file.ReadAt(header, int64(block.HeaderPoint)); err != nil {
+			return err
+		}
+		if _, err = file.ReadAt(data, int64(block.DataPoint)); err != nil {
+			return err
+		}
+		if err = s.verifySegment(block, header, data); err != nil {
+			return err
+		}
+		// Head block refers to itself
+		prev := offset
+		if len(upgraded) > 0 {
+			prev = int64(upgraded[len(upgraded)-1].Offset)
+		}
+		last = fileBlock{
+			PrevBlock:   uint64(prev),
+			HeaderPoint: uint64(offset + blockSize(CurrentFormat)),
+			HeaderSize:  uint64(len(header)),
+			DataPoint:   uint64(offset+blockSize(CurrentFormat)) + uint64(len(header)),
+			DataSize:    uint64(len(data)),
+			HeaderCRC:   checksum(header),
+			DataCRC:     checksum(data),
+		}
+		if err = last.writeTo(tmp, offset, CurrentFormat); err != nil {
+			return err
+		}
+		if _, err = tmp.Write(header); err != nil {
+			return err
+		}
+		if _, err = tmp.Write(data); err != nil {
+			return err
+		}
+		upgraded = append(upgraded, indexRecord{Offset: uint64(offset), Time: record.Time})
+		offset = last.NextBlockPoint()
+	}
+	err = s.replaceFile(tmp, upgraded, last)
+	if err != nil {
+		return err
+	}
+	s.format = CurrentFormat
+	return nil
+}
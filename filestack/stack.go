@@ -1,7 +1,10 @@
-package fstack
+// Package filestack - stack of messages (header and body) in file with index of segments.
+// Extended copy of github.com/reddec/file-stack maintained with file-stack-db
+package filestack
 
 import (
-	"encoding/binary"
+	"bytes"
+	"errors"
 	"io"
 	"log"
 	"os"
@@ -17,8 +20,16 @@ type Stack struct {
 	currentBlockPos int64
 	guard           sync.Mutex
 	file            *os.File
+	index           *os.File
 	fileName        string
 	lastAccess      time.Time
+	format          int    // Format of blocks
+	dataStart       int64  // Location of first block: size of file header or 0 for old files without header
+	revision        uint64 // Counter of changes of last segment (not changed by compaction)
+	// Online compaction state
+	compactGuard sync.Mutex
+	compacting   bool
+	compactLow   int // Minimal depth during compaction: segments below are not changed
 }
 
 // Meta-info before each physical block on fs
@@ -28,31 +39,19 @@ type fileBlock struct {
 	HeaderSize  uint64 // Size in byte of header
 	DataPoint   uint64 // Location of data begining of block
 	DataSize    uint64 // Size in byte of data
-}
-
-// Read meta-info at specified place
-func readBlockAt(reader io.ReadSeeker, offset int64) (fileBlock, error) {
-	var block fileBlock
-	_, err := reader.Seek(offset, os.SEEK_SET)
-	if err != nil {
-		return block, err
-	}
-	return block, binary.Read(reader, binary.LittleEndian, &block)
-}
-
-// Write meta-info to specified place
-func (fb *fileBlock) writeTo(writer io.WriteSeeker, offset int64) error {
-	_, err := writer.Seek(offset, os.SEEK_SET)
-	if err != nil {
-		return err
-	}
-	return binary.Write(writer, binary.LittleEndian, *fb)
+	HeaderCRC   uint32 // Checksum of header (format 2)
+	DataCRC     uint32 // Checksum of data (format 2)
+	corrupted   bool   // Signature or checksum of meta-info is not matched (format 2)
 }
 
 // Calculate next block position
 func (fb *fileBlock) NextBlockPoint() int64 { return int64(fb.DataPoint + fb.DataSize) }
 
-const fileBlockDefineSize = 8 + 8 + 8 + 8 + 8
+// Virtual block before first block: next block position is begining of data
+func (s *Stack) emptyBlock() fileBlock { return fileBlock{DataPoint: uint64(s.dataStart)} }
+
+// TempSuffix - suffix of temporary file name used during rewriting of stack file
+const TempSuffix = "#tmp"
 
 // Push header and body to stack. Returns new value of stack depth
 func (s *Stack) Push(header, data []byte) (depth int, err error) {
@@ -69,7 +68,7 @@ func (s *Stack) Push(header, data []byte) (depth int, err error) {
 		return -1, err
 	}
 	// Get place for payload
-	bodyOffset := currentOffset + fileBlockDefineSize
+	bodyOffset := currentOffset + blockSize(s.format)
 	block := fileBlock{
 		PrevBlock:   uint64(s.currentBlockPos),
 		HeaderPoint: uint64(bodyOffset),
@@ -77,8 +76,12 @@ func (s *Stack) Push(header, data []byte) (depth int, err error) {
 		DataPoint:   uint64(bodyOffset) + uint64(len(header)),
 		DataSize:    uint64(len(data)),
 	}
+	if s.format != FormatV1 {
+		block.HeaderCRC = checksum(header)
+		block.DataCRC = checksum(data)
+	}
 	// Write block meta-info
-	err = binary.Write(file, binary.LittleEndian, block)
+	err = block.write(file, s.format)
 	if err != nil {
 		file.Seek(currentOffset, os.SEEK_SET)
 		return -1, err
@@ -95,9 +98,78 @@ func (s *Stack) Push(header, data []byte) (depth int, err error) {
 		file.Seek(currentOffset, os.SEEK_SET)
 		return -1, err
 	}
+	// Write index record
+	err = s.writeIndex([]indexRecord{{Offset: uint64(currentOffset), Time: s.lastAccess.UnixNano()}}, s.depth)
+	if err != nil {
+		file.Truncate(currentOffset)
+		file.Seek(currentOffset, os.SEEK_SET)
+		return -1, err
+	}
 	s.depth++
 	s.currentBlockPos = currentOffset
 	s.currentBlock = block
+	s.revision++
+	return s.depth, nil
+}
+
+// PushMany - push segments (pairs of headers and data items) to stack with one write to stack file and
+// one write to index. Returns new value of stack depth: depth index of first pushed segment is depth-len(data)+1
+func (s *Stack) PushMany(headers, data [][]byte) (depth int, err error) {
+	if len(headers) != len(data) {
+		return -1, errors.New("number of headers and data items is not matched")
+	}
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if len(data) == 0 {
+		return s.depth, nil
+	}
+	s.lastAccess = time.Now()
+	file, err := s.getFile()
+	if err != nil {
+		return -1, err
+	}
+	startOffset := s.currentBlock.NextBlockPoint()
+	var (
+		buffer          = &bytes.Buffer{}
+		records         = make([]indexRecord, 0, len(data))
+		block           = s.currentBlock
+		currentBlockPos = s.currentBlockPos
+		offset          = startOffset
+	)
+	for i := range data {
+		bodyOffset := offset + blockSize(s.format)
+		block = fileBlock{
+			PrevBlock:   uint64(currentBlockPos),
+			HeaderPoint: uint64(bodyOffset),
+			HeaderSize:  uint64(len(headers[i])),
+			DataPoint:   uint64(bodyOffset) + uint64(len(headers[i])),
+			DataSize:    uint64(len(data[i])),
+		}
+		if s.format != FormatV1 {
+			block.HeaderCRC = checksum(headers[i])
+			block.DataCRC = checksum(data[i])
+		}
+		block.write(buffer, s.format)
+		buffer.Write(headers[i])
+		buffer.Write(data[i])
+		records = append(records, indexRecord{Offset: uint64(offset), Time: s.lastAccess.UnixNano()})
+		currentBlockPos = offset
+		offset = block.NextBlockPoint()
+	}
+	_, err = file.WriteAt(buffer.Bytes(), startOffset)
+	if err != nil {
+		file.Truncate(startOffset)
+		return -1, err
+	}
+	err = s.writeIndex(records, s.depth)
+	if err != nil {
+		file.Truncate(startOffset)
+		return -1, err
+	}
+	s.depth += len(records)
+	s.currentBlockPos = currentBlockPos
+	s.currentBlock = block
+	s.revision++
 	return s.depth, nil
 }
 
@@ -125,24 +197,43 @@ func (s *Stack) Pop() (header, data []byte, err error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	// Read new block if current block is not head
-	var newBlock fileBlock
-	if s.currentBlockPos != 0 {
-		newBlock, err = readBlockAt(file, int64(s.currentBlock.PrevBlock))
+	// Segment is removed even if it is corrupted
+	corruption := s.verifySegment(s.currentBlock, header, data)
+	err = s.removeLast(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, data, corruption
+}
+
+// Remove last segment from stack file and index under lock
+func (s *Stack) removeLast(file *os.File) error {
+	// Read new block if current block is not head (head refers to itself)
+	newBlock := s.emptyBlock()
+	if s.currentBlock.PrevBlock != uint64(s.currentBlockPos) {
+		var err error
+		newBlock, err = readBlockAt(file, int64(s.currentBlock.PrevBlock), s.format)
 		if err != nil {
-			return nil, nil, err
+			return err
 		}
 	}
 	// Remove tail
-	err = file.Truncate(int64(s.currentBlockPos))
+	err := file.Truncate(int64(s.currentBlockPos))
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	// Remove index record. Extra records are ignored and rebuilt on next open
+	if index, err := s.getIndex(); err == nil {
+		index.Truncate(int64(s.depth-1) * indexRecordSize)
 	}
 	s.depth--
 	s.currentBlockPos = int64(s.currentBlock.PrevBlock)
 	s.currentBlock = newBlock
-
-	return header, data, nil
+	s.revision++
+	if s.compacting && s.depth < s.compactLow {
+		s.compactLow = s.depth
+	}
+	return nil
 }
 
 // Peak of stack - get one segment from stack but not remove
@@ -169,7 +260,46 @@ func (s *Stack) Peak() (header, data []byte, err error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	return header, data, nil
+	return header, data, s.verifySegment(s.currentBlock, header, data)
+}
+
+// At - get segment by depth index (1 - first pushed segment) without iterating over stack.
+// Location of segment is taken from index. Returns nil,nil,nil if there is no such segment
+func (s *Stack) At(depth int) (header, data []byte, err error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if depth < 1 || depth > s.depth {
+		return nil, nil, nil
+	}
+	s.lastAccess = time.Now()
+	file, err := s.getFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	block := s.currentBlock
+	if depth != s.depth {
+		record, err := s.readIndexRecord(depth - 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		block, err = readBlockAt(file, int64(record.Offset), s.format)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	data = make([]byte, block.DataSize)
+	header = make([]byte, block.HeaderSize)
+	// Read header
+	_, err = file.ReadAt(header, int64(block.HeaderPoint))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Read data
+	_, err = file.ReadAt(data, int64(block.DataPoint))
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, data, s.verifySegment(block, header, data)
 }
 
 // PeakHeader get only header part from tail segment from stack without remove
@@ -219,8 +349,7 @@ func (s *Stack) IterateBackward(handler func(depth int, header io.Reader, body i
 	currentBlockOffset = uint64(s.currentBlockPos)
 	depth := s.depth
 	for {
-		body := io.NewSectionReader(file, int64(currentBlock.DataPoint), int64(currentBlock.DataSize))
-		header := io.NewSectionReader(file, int64(currentBlock.HeaderPoint), int64(currentBlock.HeaderSize))
+		header, body := s.segmentReaders(file, currentBlock)
 		// invoke block processor
 		if handler != nil && !handler(depth, header, body) {
 			return nil
@@ -231,11 +360,11 @@ func (s *Stack) IterateBackward(handler func(depth int, header io.Reader, body i
 
 		depth--
 		if currentBlock.PrevBlock == currentBlockOffset {
-			// First block has prev block = 0
+			// First block refers to itself
 			break
 		}
 		currentBlockOffset = currentBlock.PrevBlock
-		currentBlock, err = readBlockAt(file, int64(currentBlock.PrevBlock))
+		currentBlock, err = readBlockAt(file, int64(currentBlock.PrevBlock), s.format)
 		if err != nil {
 			return err
 		}
@@ -268,10 +397,11 @@ func (s *Stack) IterateForward(handler func(depth int, header io.Reader, body io
 	}
 	defer file.Seek(0, os.SEEK_END)
 	var (
-		currentBlock       fileBlock // Current block description
-		currentBlockOffset uint64    // Current block offset from begining of file
+		currentBlock       = s.emptyBlock()      // Current block description
+		currentBlockOffset = uint64(s.dataStart) // Current block offset from begining of file
 	)
 	var depth int
+	var offsets []uint64
 	for currentBlock.NextBlockPoint() < fileSize {
 		newPos := currentBlock.NextBlockPoint()
 		if newPos > fileSize {
@@ -279,9 +409,9 @@ func (s *Stack) IterateForward(handler func(depth int, header io.Reader, body io
 			file.Truncate(int64(currentBlockOffset))
 			break
 		}
-		block, err := readBlockAt(file, newPos)
+		block, err := readBlockAt(file, newPos, s.format)
 		// Non-full meta-info?
-		if err == io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			log.Println("Broken meta info at", newPos, "!trunc!")
 			file.Truncate(newPos)
 			break
@@ -291,17 +421,28 @@ func (s *Stack) IterateForward(handler func(depth int, header io.Reader, body io
 			log.Println("Can't read block at", newPos)
 			return err
 		}
+		// Meta-info of streamed block is written after body: block of interrupted push is incomplete
+		if block.NextBlockPoint() <= newPos || block.NextBlockPoint() > fileSize {
+			log.Println("Incomplete block at", newPos, "!trunc!")
+			file.Truncate(newPos)
+			break
+		}
+		if block.corrupted {
+			log.Println("Corrupted meta info at", newPos)
+		}
 		// Check back-ref
 		if block.PrevBlock != currentBlockOffset {
 			log.Println("Bad back reference", block.PrevBlock, "!=", currentBlockOffset, "!upd!")
 			block.PrevBlock = currentBlockOffset
-			block.writeTo(file, newPos)
+			if !block.corrupted {
+				block.writeTo(file, newPos, s.format)
+			}
 		}
 		// Update current state
 		currentBlockOffset = uint64(newPos)
 		currentBlock = block
-		body := io.NewSectionReader(file, int64(currentBlock.DataPoint), int64(currentBlock.DataSize))
-		header := io.NewSectionReader(file, int64(currentBlock.HeaderPoint), int64(currentBlock.HeaderSize))
+		offsets = append(offsets, currentBlockOffset)
+		header, body := s.segmentReaders(file, currentBlock)
 		// invoke block processor
 		if handler != nil && !handler(depth, header, body) {
 			return nil
@@ -310,17 +451,40 @@ func (s *Stack) IterateForward(handler func(depth int, header io.Reader, body io
 	}
 	s.depth = depth
 	s.currentBlock = currentBlock
+	s.revision++
 	s.currentBlockPos = int64(currentBlockOffset)
-	return nil
+	return s.checkIndex(offsets)
 }
 
 // Repare stack segements
 func (s *Stack) Repare() error { return s.IterateForward(nil) }
 
+// Sync - commit stack file and index to stable storage. Closed stack is not reopened: nothing is synced
+func (s *Stack) Sync() error {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	index, err := s.getIndex()
+	if err != nil {
+		return err
+	}
+	return index.Sync()
+}
+
 // Close backend stack file. If access is requried, file will automatically reopened
 func (s *Stack) Close() error {
 	s.guard.Lock()
 	defer s.guard.Unlock()
+	if s.index != nil {
+		s.index.Close()
+		s.index = nil
+	}
 	if s.file != nil {
 		err := s.file.Close()
 		s.file = nil
@@ -340,8 +504,11 @@ func (s *Stack) getFile() (*os.File, error) {
 	return s.file, nil
 }
 
-// OpenStack - open or create stack
+// OpenStack - open or create stack. Existing file which is not a stack is not opened for writing (ErrNotStack)
 func OpenStack(filename string) (*Stack, error) {
+	if _, _, err := CheckFile(filename); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
 		return nil, err
@@ -358,10 +525,15 @@ func CreateStack(filename string) (*Stack, error) {
 	return NewStack(file)
 }
 
-// NewStack - create new stack based on file
+// NewStack - create new stack based on file. File is closed and ErrNotStack is returned if file is not a stack
 func NewStack(file *os.File) (*Stack, error) {
-	stack := &Stack{file: file, fileName: file.Name()}
-	err := stack.Repare()
+	format, dataStart, err := detectFormat(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	stack := &Stack{file: file, fileName: file.Name(), format: format, dataStart: dataStart}
+	err = stack.Repare()
 	if err != nil {
 		stack.Close()
 		return nil, err
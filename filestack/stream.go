@@ -0,0 +1,178 @@
+package filestack
+
+import (
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// PushFrom - push header and body read from reader without loading body to memory. Size of body may be
+// unknown (negative), otherwise exactly size bytes are read. Meta-info of block is written after body,
+// so block of interrupted push is truncated by repair. Stack is locked until body is read.
+// Returns new value of stack depth
+func (s *Stack) PushFrom(header []byte, body io.Reader, size int64) (depth int, err error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	s.lastAccess = time.Now()
+	file, err := s.getFile()
+	if err != nil {
+		return -1, err
+	}
+	currentOffset := s.currentBlock.NextBlockPoint()
+	bodyOffset := currentOffset + blockSize(s.format)
+	block := fileBlock{
+		PrevBlock:   uint64(s.currentBlockPos),
+		HeaderPoint: uint64(bodyOffset),
+		HeaderSize:  uint64(len(header)),
+		DataPoint:   uint64(bodyOffset) + uint64(len(header)),
+	}
+	// Remove incomplete block on any error
+	defer func() {
+		if err != nil {
+			file.Truncate(currentOffset)
+			file.Seek(currentOffset, os.SEEK_SET)
+		}
+	}()
+	// Write header
+	_, err = file.WriteAt(header, bodyOffset)
+	if err != nil {
+		return -1, err
+	}
+	// Write data
+	_, err = file.Seek(int64(block.DataPoint), os.SEEK_SET)
+	if err != nil {
+		return -1, err
+	}
+	hash := crc32.New(crcTable)
+	writer := io.MultiWriter(file, hash)
+	var written int64
+	if size >= 0 {
+		written, err = io.CopyN(writer, body, size)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	} else {
+		written, err = io.Copy(writer, body)
+	}
+	if err != nil {
+		return -1, err
+	}
+	block.DataSize = uint64(written)
+	if s.format != FormatV1 {
+		block.HeaderCRC = checksum(header)
+		block.DataCRC = hash.Sum32()
+	}
+	// Write block meta-info
+	err = block.writeTo(file, currentOffset, s.format)
+	if err != nil {
+		return -1, err
+	}
+	// Write index record
+	err = s.writeIndex([]indexRecord{{Offset: uint64(currentOffset), Time: s.lastAccess.UnixNano()}}, s.depth)
+	if err != nil {
+		return -1, err
+	}
+	s.depth++
+	s.currentBlockPos = currentOffset
+	s.currentBlock = block
+	s.revision++
+	return s.depth, nil
+}
+
+// SegmentReader - reader of segment body. Header is loaded on open
+type SegmentReader struct {
+	io.Reader
+	Header []byte // Segment header
+	Size   int64  // Size of body
+	file   *os.File
+}
+
+// Close file of reader
+func (sr *SegmentReader) Close() error { return sr.file.Close() }
+
+// Reader which returns io.ErrUnexpectedEOF if file is shorter then expected (segment is popped during reading
+// by separate file descriptor)
+type cutReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (cr *cutReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.remaining -= int64(n)
+	if err == io.EOF && cr.remaining > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Open - reader of segment by depth index (1 - first pushed segment). Body is read from separate file
+// descriptor, so stack is not locked during reading and reader is not affected by compaction. Checksum of body
+// is checked at the end of reading. Returns nil if there is no such segment
+func (s *Stack) Open(depth int) (*SegmentReader, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if depth < 1 || depth > s.depth {
+		return nil, nil
+	}
+	s.lastAccess = time.Now()
+	file, err := os.Open(s.fileName)
+	if err != nil {
+		return nil, err
+	}
+	block := s.currentBlock
+	if depth != s.depth {
+		record, err := s.readIndexRecord(depth - 1)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		block, err = readBlockAt(file, int64(record.Offset), s.format)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	header, err := s.readHeader(file, block)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	_, body := s.segmentReaders(file, block)
+	return &SegmentReader{Reader: body, Header: header, Size: int64(block.DataSize), file: file}, nil
+}
+
+// Revision - depth of stack and counter of changes of last segment. Counter is changed by push and pop of
+// last segment, but not by compaction
+func (s *Stack) Revision() (int, uint64) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return s.depth, s.revision
+}
+
+// PopRevision - remove last segment if depth and last segment of stack are not changed since Revision. Segment
+// is removed even if it is corrupted. Returns false if stack is changed
+func (s *Stack) PopRevision(depth int, revision uint64) (bool, error) {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if s.depth == 0 || s.depth != depth || s.revision != revision {
+		return false, nil
+	}
+	s.lastAccess = time.Now()
+	file, err := s.getFile()
+	if err != nil {
+		return false, err
+	}
+	if err = s.removeLast(file); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Read and verify header of segment. Segment with corrupted meta-info or header is not readable
+func (s *Stack) readHeader(file *os.File, block fileBlock) ([]byte, error) {
+	reader, _ := s.segmentReaders(file, block)
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,120 @@
+package fstack
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// At - get message from stack by depth index (1 - first pushed message).
+// Message location is taken from stack index without iterating over stack
+func (db *Database) At(key string, depth int) (header, data []byte, err error) {
+	s, err := db.Find(key, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s == nil {
+		return nil, nil, ErrNotFound
+	}
+	header, data, err = s.At(depth)
+	if err != nil && err != ErrCorrupted {
+		return nil, nil, err
+	}
+	if header == nil || data == nil {
+		return nil, nil, ErrOutOfRange
+	}
+	return header, data, err
+}
+
+// Range - get messages from stack by depth indexes from and to (inclusive) ordered from first to last.
+// Bounds are limited by current stack depth. As by At, corrupted messages are returned as is: ErrCorrupted
+// is returned with all messages of range
+func (db *Database) Range(key string, from, to int) ([]Segment, error) {
+	s, err := db.Find(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrNotFound
+	}
+	if from < 1 {
+		from = 1
+	}
+	if depth := s.Depth(); to > depth {
+		to = depth
+	}
+	segments := []Segment{}
+	var corruption error
+	for depth := from; depth <= to; depth++ {
+		header, data, err := s.At(depth)
+		if err == ErrCorrupted {
+			corruption = err
+		} else if err != nil {
+			return nil, err
+		}
+		if header == nil || data == nil {
+			// Stack was changed
+			break
+		}
+		segments = append(segments, Segment{Depth: depth, Header: header, Data: data})
+	}
+	return segments, corruption
+}
+
+// History - get up to limit messages from stack skipping offset messages. Messages are ordered from last
+// to first (offset is counted from last message) or from first to last if ascending is true. Stack file is
+// not changed: corrupted message is reported by ErrCorrupted
+func (db *Database) History(key string, offset, limit int, ascending bool) ([]Segment, error) {
+	s, err := db.Find(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrNotFound
+	}
+	segments := []Segment{}
+	if limit <= 0 {
+		return segments, nil
+	}
+	var readErr error
+	collect := func(depth int, header io.Reader, body io.Reader) bool {
+		if offset > 0 {
+			offset--
+			return true
+		}
+		segment := Segment{Depth: depth}
+		segment.Header, readErr = ioutil.ReadAll(header)
+		if readErr != nil {
+			return false
+		}
+		segment.Data, readErr = ioutil.ReadAll(body)
+		if readErr != nil {
+			return false
+		}
+		segments = append(segments, segment)
+		return len(segments) < limit
+	}
+	if ascending {
+		// Messages are taken by index instead of forward iteration, which repairs stack file
+		depth := s.Depth()
+		for i := offset + 1; i <= depth && len(segments) < limit; i++ {
+			header, data, err := s.At(i)
+			if err != nil {
+				return nil, err
+			}
+			if header == nil || data == nil {
+				// Stack was changed
+				break
+			}
+			segments = append(segments, Segment{Depth: i, Header: header, Data: data})
+		}
+		return segments, nil
+	}
+	err = s.IterateBackward(collect)
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
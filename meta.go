@@ -0,0 +1,95 @@
+package fstack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// MetaSuffix - suffix of file with metadata of stack. Metadata file is placed near stack file
+const MetaSuffix = "#meta"
+
+// Metadata of stack from cache or metadata file. Empty metadata if file not exists
+func (st *storage) loadMeta(key string) (map[string]string, error) {
+	if meta, ok := st.meta[key]; ok {
+		return meta, nil
+	}
+	meta := map[string]string{}
+	data, err := ioutil.ReadFile(st.fileName(key) + MetaSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &meta); err != nil {
+			return nil, err
+		}
+	}
+	st.meta[key] = meta
+	return meta, nil
+}
+
+// Meta - copy of stack metadata: named values saved with stack (for example, format of message headers).
+// Returns ErrNotFound if stack not exists
+func (db *Database) Meta(key string) (map[string]string, error) {
+	s, err := db.Find(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrNotFound
+	}
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+	meta, err := db.loadMeta(db.fullKey(key))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(meta))
+	for name, value := range meta {
+		res[name] = value
+	}
+	return res, nil
+}
+
+// SetMeta - save value of stack metadata. Stack is created if not exists. Empty value removes name
+func (db *Database) SetMeta(key, name, value string) error {
+	if _, err := db.Find(key, true); err != nil {
+		return err
+	}
+	key = db.fullKey(key)
+	db.metaLock.Lock()
+	defer db.metaLock.Unlock()
+	meta, err := db.loadMeta(key)
+	if err != nil {
+		return err
+	}
+	updated := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		updated[k] = v
+	}
+	if value == "" {
+		delete(updated, name)
+	} else {
+		updated[name] = value
+	}
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	fileName := db.fileName(key) + MetaSuffix
+	if err = ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(fileName+".tmp", fileName); err != nil {
+		return err
+	}
+	db.meta[key] = updated
+	return nil
+}
+
+// Drop cached metadata of removed stack
+func (st *storage) forgetMeta(key string) {
+	st.metaLock.Lock()
+	defer st.metaLock.Unlock()
+	delete(st.meta, key)
+}
@@ -0,0 +1,131 @@
+package fstack
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/reddec/file-stack-db/filestack"
+)
+
+// Retention policy of stack history. Zero value of limit means no limit
+type Retention struct {
+	MaxDepth int           // Keep only last MaxDepth messages
+	MaxBytes int64         // Keep only last messages which fit to MaxBytes of stack file
+	MaxAge   time.Duration // Drop messages older then MaxAge. Messages with unknown push time are kept
+}
+
+// IsZero - policy without any limits
+func (r Retention) IsZero() bool { return r.MaxDepth <= 0 && r.MaxBytes <= 0 && r.MaxAge <= 0 }
+
+// Count of first (oldest) segments which have to be dropped by policy
+func (r Retention) excess(segments []filestack.SegmentInfo, now time.Time) int {
+	drop := 0
+	if r.MaxDepth > 0 && len(segments) > r.MaxDepth {
+		drop = len(segments) - r.MaxDepth
+	}
+	if r.MaxBytes > 0 {
+		var size int64
+		for i := len(segments) - 1; i >= drop; i-- {
+			size += segments[i].Size
+			if size > r.MaxBytes {
+				drop = i + 1
+				break
+			}
+		}
+	}
+	if r.MaxAge > 0 {
+		for i := len(segments) - 1; i >= drop; i-- {
+			pushed := segments[i].Pushed
+			if !pushed.IsZero() && now.Sub(pushed) > r.MaxAge {
+				drop = i + 1
+				break
+			}
+		}
+	}
+	return drop
+}
+
+// RetentionInterval - apply retention policies in background with specified interval
+func RetentionInterval(interval time.Duration) Option {
+	return func(db *Database) { db.retentionInterval = interval }
+}
+
+// SetRetention - set retention policy of section (stack or sub-section) and all nested sections.
+// The most specific policy is applied to stack. Empty section means whole database (or sub-section).
+// Zero policy disables limits for section
+func (db *Database) SetRetention(section string, policy Retention) {
+	db.retentionLock.Lock()
+	defer db.retentionLock.Unlock()
+	db.retention[db.fullKey(section)] = policy
+}
+
+// RetentionOf - retention policy applied to stack
+func (db *Database) RetentionOf(key string) Retention {
+	key = db.fullKey(key)
+	db.retentionLock.RLock()
+	defer db.retentionLock.RUnlock()
+	for {
+		if policy, ok := db.retention[key]; ok {
+			return policy
+		}
+		if key == "" {
+			return Retention{}
+		}
+		if pos := strings.LastIndex(key, SectionSeparator); pos != -1 {
+			key = key[:pos]
+		} else {
+			key = ""
+		}
+	}
+}
+
+// ApplyRetention - drop old messages from all known stacks in database (or sub-section) by retention policies.
+// Stacks are compacted online. Returns first error but processes all stacks
+func (db *Database) ApplyRetention() error {
+	var err error
+	for _, name := range db.exceeded() {
+		_, e := db.Compact(name)
+		if err == nil && e != ErrNotFound {
+			err = e
+		}
+	}
+	return err
+}
+
+// Names of stacks in database (or sub-section) which have messages to be dropped by retention policies
+func (db *Database) exceeded() []string {
+	var names []string
+	now := time.Now()
+	for _, name := range db.Names() {
+		policy := db.RetentionOf(name)
+		if policy.IsZero() {
+			continue
+		}
+		// Stack is taken through pool of opened files to keep limit of opened files
+		s, err := db.Find(name, false)
+		if err != nil || s == nil {
+			continue
+		}
+		segments, err := s.Segments()
+		if err != nil {
+			log.Println("Failed read segments of", name, err)
+			continue
+		}
+		if policy.excess(segments, now) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Schedule compaction of stacks with messages to be dropped by retention policies
+func (db *Database) retainer() {
+	for _ = range db.retentionTicker.C {
+		for _, name := range db.exceeded() {
+			if !db.ScheduleCompact(name) {
+				log.Println("Compaction queue is full, retention of", name, "postponed")
+			}
+		}
+	}
+}
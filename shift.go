@@ -0,0 +1,45 @@
+package fstack
+
+// Shift - get and remove first (oldest) message from stack. Stack file is rewritten,
+// so operation is expensive for deep stacks. Depth index of returned message is 1
+func (db *Database) Shift(key string) (Segment, error) {
+	var segment Segment
+	defer db.lockKeys(db.fullKey(key))()
+	s, err := db.Find(key, false)
+	if err != nil {
+		return segment, err
+	}
+	if s == nil {
+		return segment, ErrNotFound
+	}
+	segment.Header, segment.Data, err = s.Shift()
+	if err != nil && err != ErrCorrupted {
+		return segment, err
+	}
+	if segment.Header == nil || segment.Data == nil {
+		return segment, ErrEmpty
+	}
+	segment.Depth = 1
+	db.emit(EventPop, db.fullKey(key), s.Depth())
+	return segment, err
+}
+
+// Unshift - insert message before first (oldest) message of stack (stack is created if not exists).
+// Stack file is rewritten, so operation is expensive for deep stacks. Returns new depth of stack
+func (db *Database) Unshift(key string, header, data []byte) (int, error) {
+	defer db.lockKeys(db.fullKey(key))()
+	s, err := db.Find(key, true)
+	if err != nil {
+		return -1, err
+	}
+	depth, err := s.Unshift(header, data)
+	if err != nil {
+		return -1, err
+	}
+	if err = db.syncPushed(s); err != nil {
+		return -1, err
+	}
+	db.notify(db.fullKey(key))
+	db.emit(EventPush, db.fullKey(key), depth)
+	return depth, nil
+}
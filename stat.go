@@ -0,0 +1,41 @@
+package fstack
+
+import "time"
+
+// Stat - summary of stack
+type Stat struct {
+	Depth       int       // Number of messages
+	Size        int64     // Size of all messages in stack file including meta-info (bytes)
+	Format      int       // Version of stack file format
+	LastAccess  time.Time // Last read or write
+	FirstPushed time.Time // Push time of first message. Zero if stack is empty or time is unknown
+	LastPushed  time.Time // Push time of last message. Zero if stack is empty or time is unknown
+}
+
+// Stat - summary of existing stack. Returns ErrNotFound if stack not exists
+func (db *Database) Stat(key string) (Stat, error) {
+	var stat Stat
+	defer db.lockKeys(db.fullKey(key))()
+	s, err := db.Find(key, false)
+	if err != nil {
+		return stat, err
+	}
+	if s == nil {
+		return stat, ErrNotFound
+	}
+	segments, err := s.Segments()
+	if err != nil {
+		return stat, err
+	}
+	for _, segment := range segments {
+		stat.Size += segment.Size
+	}
+	if len(segments) > 0 {
+		stat.FirstPushed = segments[0].Pushed
+		stat.LastPushed = segments[len(segments)-1].Pushed
+	}
+	stat.Depth = s.Depth()
+	stat.Format = s.Format()
+	stat.LastAccess = s.LastAccess()
+	return stat, nil
+}
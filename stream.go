@@ -0,0 +1,177 @@
+package fstack
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Stream - message with body read from stack file
+type Stream struct {
+	io.ReadCloser
+	Depth  int    // Depth index of message (1 - first pushed message)
+	Header []byte // Message header
+	Size   int64  // Size of body
+}
+
+// Prefix of temporary files in root dir with bodies of messages which are being pushed
+const spoolPrefix = "#spool-"
+
+// PushFrom - push message with body read from reader without loading it to memory (stack is created if not
+// exists) and notify waiters. Exactly size bytes are read or until EOF if size is negative. Body is spooled to
+// temporary file without lock, so slow reader doesn't block the stack: stack is locked only while spooled body
+// is copied to stack file. Message is synced by durability mode. Returns new depth of stack
+func (db *Database) PushFrom(key string, header []byte, body io.Reader, size int64) (int, error) {
+	if db.fullKey(key) == "" {
+		return -1, ErrInvalidKey
+	}
+	spool, err := db.spool(body, size)
+	if err != nil {
+		return -1, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	defer db.lockKeys(db.fullKey(key))()
+	s, err := db.Find(key, true)
+	if err != nil {
+		return -1, err
+	}
+	depth, err := s.PushFrom(header, spool, -1)
+	if err != nil {
+		return -1, err
+	}
+	// Message is not acknowledged if it couldn't be synced
+	if err = db.syncPushed(s); err != nil {
+		return -1, err
+	}
+	db.notify(db.fullKey(key))
+	db.emit(EventPush, db.fullKey(key), depth)
+	return depth, nil
+}
+
+// Copy body to temporary file. Returned file is positioned at the begining of body
+func (st *storage) spool(body io.Reader, size int64) (*os.File, error) {
+	spool, err := ioutil.TempFile(st.rootDir, spoolPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		_, err = io.CopyN(spool, body, size)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	} else {
+		_, err = io.Copy(spool, body)
+	}
+	if err == nil {
+		_, err = spool.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+	return spool, nil
+}
+
+// Remove temporary files of pushes interrupted by crash
+func (st *storage) removeSpools() error {
+	names, err := filepath.Glob(filepath.Join(st.rootDir, spoolPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open - stream of message by depth index (1 - first pushed message), 0 - last message. Stack is not locked
+// while stream is read: stream of removed message returns io.ErrUnexpectedEOF. Corrupted body is detected
+// at the end of stream (ErrCorrupted). Stream must be closed
+func (db *Database) Open(key string, depth int) (*Stream, error) {
+	s, err := db.Find(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrNotFound
+	}
+	if depth == 0 {
+		// Non-atomic: depth may be changed by concurrent operation
+		if depth = s.Depth(); depth == 0 {
+			return nil, ErrEmpty
+		}
+	}
+	reader, err := s.Open(depth)
+	if err != nil {
+		return nil, err
+	}
+	if reader == nil {
+		return nil, ErrOutOfRange
+	}
+	return &Stream{ReadCloser: reader, Depth: depth, Header: reader.Header, Size: reader.Size}, nil
+}
+
+// PopStream - pass last message to handler and remove it if handler returns nil. Message is waited up to
+// timeout if stack is empty or not exists (see PopWait). Stack is not locked while handler reads the stream:
+// message is removed only if it is still last message of stack after handler returns, otherwise it is kept and
+// ErrChanged is returned. Corrupted message is removed as by Pop and ErrCorrupted is returned
+func (db *Database) PopStream(key string, timeout time.Duration, handler func(stream *Stream) error) error {
+	fullKey := db.fullKey(key)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		// Get notification channel before pop to not miss push between them
+		pushed := db.waiter(fullKey)
+		err := db.popStream(key, handler)
+		if err != ErrEmpty && err != ErrNotFound {
+			return err
+		}
+		select {
+		case <-pushed:
+		case <-timer.C:
+			return err
+		}
+	}
+}
+
+func (db *Database) popStream(key string, handler func(stream *Stream) error) error {
+	s, err := db.Find(key, false)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return ErrNotFound
+	}
+	// Stream is read from separate file descriptor without lock
+	depth, revision := s.Revision()
+	if depth == 0 {
+		return ErrEmpty
+	}
+	reader, err := s.Open(depth)
+	if err == nil && reader == nil {
+		return ErrEmpty
+	}
+	if err == nil {
+		err = handler(&Stream{ReadCloser: reader, Depth: depth, Header: reader.Header, Size: reader.Size})
+		reader.Close()
+	}
+	if err != nil && err != ErrCorrupted {
+		return err
+	}
+	defer db.lockKeys(db.fullKey(key))()
+	popped, popErr := s.PopRevision(depth, revision)
+	if popErr != nil {
+		return popErr
+	}
+	if !popped {
+		return ErrChanged
+	}
+	db.emit(EventPop, db.fullKey(key), depth-1)
+	return err
+}
@@ -0,0 +1,104 @@
+package fstack
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/reddec/file-stack-db/filestack"
+)
+
+// SyncMode - durability guarantee of pushed messages
+type SyncMode int
+
+// Durability modes
+const (
+	SyncNone     SyncMode = iota // Messages are written to OS cache and synced by OS
+	SyncAlways                   // Stack file is synced before push is acknowledged
+	SyncInterval                 // Changed stacks are synced together periodically (group commit)
+)
+
+// Interval of group commit if it is not specified
+const defaultSyncInterval = 100 * time.Millisecond
+
+// ErrUnknownSyncMode - name of durability mode is not known
+var ErrUnknownSyncMode = errors.New("unknown sync mode (none, always or interval expected)")
+
+func (mode SyncMode) String() string {
+	switch mode {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	}
+	return "none"
+}
+
+// ParseSyncMode - get durability mode by name: none, always or interval
+func ParseSyncMode(name string) (SyncMode, error) {
+	for _, mode := range []SyncMode{SyncNone, SyncAlways, SyncInterval} {
+		if mode.String() == name {
+			return mode, nil
+		}
+	}
+	return SyncNone, ErrUnknownSyncMode
+}
+
+// Durability - sync pushed messages by mode. Interval is used only for SyncInterval mode (100ms if not positive)
+func Durability(mode SyncMode, interval time.Duration) Option {
+	return func(db *Database) {
+		db.syncMode = mode
+		db.syncInterval = interval
+	}
+}
+
+// SyncMode - durability guarantee of pushed messages
+func (db *Database) SyncMode() SyncMode { return db.syncMode }
+
+// Sync pushed message by durability mode
+func (db *Database) syncPushed(s *filestack.Stack) error {
+	switch db.syncMode {
+	case SyncAlways:
+		return s.Sync()
+	case SyncInterval:
+		db.syncLock.Lock()
+		db.dirty[s] = true
+		db.syncLock.Unlock()
+	}
+	return nil
+}
+
+// Exclude stack from group commit. Returns true if stack was changed after last sync
+func (st *storage) forgetDirty(s *filestack.Stack) bool {
+	st.syncLock.Lock()
+	defer st.syncLock.Unlock()
+	dirty := st.dirty[s]
+	delete(st.dirty, s)
+	return dirty
+}
+
+// Sync all stacks changed after last sync. Stacks closed after change are synced by close and are not reopened.
+// Removal of transaction journals is synced before stacks: reappeared journal would undo synced changes
+func (st *storage) syncDirty() {
+	st.syncLock.Lock()
+	dirty, dirtyRoot := st.dirty, st.dirtyRoot
+	st.dirty = make(map[*filestack.Stack]bool)
+	st.dirtyRoot = false
+	st.syncLock.Unlock()
+	if dirtyRoot {
+		if err := syncDir(st.rootDir); err != nil {
+			log.Println("Failed sync root dir:", err)
+		}
+	}
+	for s := range dirty {
+		if err := s.Sync(); err != nil {
+			log.Println("Failed sync stack:", err)
+		}
+	}
+}
+
+func (db *Database) syncer() {
+	for _ = range db.syncTicker.C {
+		db.syncDirty()
+	}
+}
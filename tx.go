@@ -0,0 +1,450 @@
+package fstack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reddec/file-stack-db/filestack"
+)
+
+// ErrTxDone - transaction is already committed or rolled back
+var ErrTxDone = errors.New("transaction is already committed or rolled back")
+
+// Prefix of intent journal file name of transaction in root dir
+const txJournalPrefix = "#tx-"
+
+var txSequence uint64
+
+// Tx - transaction over many stacks. Operations are buffered and applied all or nothing by Commit
+type Tx struct {
+	db   *Database
+	ops  []txOp
+	done bool
+}
+
+type txOp struct {
+	pop    bool
+	key    string
+	to     string // Destination of popped message (move)
+	header []byte
+	data   []byte
+}
+
+// Intent journal of transaction: saved top segments of affected stacks
+type txJournal struct {
+	Stacks []txCheckpoint
+}
+
+type txCheckpoint struct {
+	Key string // Full key of stack
+	New bool   `json:",omitempty"` // Stack is created by transaction: it is removed by undo
+	filestack.Checkpoint
+}
+
+// Planned changes of one stack
+type txPlan struct {
+	stack   *filestack.Stack // Nil for stack which is created by transaction
+	keep    int              // Number of messages which are not popped
+	headers [][]byte
+	data    [][]byte
+}
+
+// Lock of stack key held by push, pop and transaction commit
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Move - atomically pop last message from src stack and push it to dst stack (like RPOPLPUSH in Redis).
+// Message is never lost or duplicated: interrupted move is undone by next Scan. Returns moved message with
+// depth index in dst stack
+func (db *Database) Move(src, dst string) (Segment, error) {
+	tx := db.Begin()
+	tx.Move(src, dst)
+	results, err := tx.Commit()
+	if err != nil {
+		return Segment{}, err
+	}
+	return results[0], nil
+}
+
+// Begin new transaction. Transaction doesn't hold any stacks until commit
+func (db *Database) Begin() *Tx { return &Tx{db: db} }
+
+// Push - add push of message to transaction
+func (tx *Tx) Push(key string, header, data []byte) {
+	tx.ops = append(tx.ops, txOp{key: key, header: header, data: data})
+}
+
+// Pop - add pop of last message to transaction. Message pushed by the same transaction may be popped
+func (tx *Tx) Pop(key string) { tx.ops = append(tx.ops, txOp{pop: true, key: key}) }
+
+// Move - add pop of last message from src and push of it to dst to transaction
+func (tx *Tx) Move(src, dst string) { tx.ops = append(tx.ops, txOp{pop: true, key: src, to: dst}) }
+
+// Rollback - discard all operations of transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+	return nil
+}
+
+// Commit - apply all operations atomically. Affected stacks are locked during commit and top messages of
+// stacks are saved to intent journal before changes, so interrupted commit is undone by next Scan. Journal and
+// changed stacks are synced by durability mode: commit survives OS crash only in SyncAlways mode.
+// Returns result of each operation in order: depth index of pushed message, popped message with depth index or
+// moved message with depth index in destination stack. If any operation fails (for example pop from empty stack), no changes are applied
+func (tx *Tx) Commit() ([]Segment, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	tx.done = true
+	db := tx.db
+	var keys []string
+	plans := make(map[string]*txPlan)
+	create := make(map[string]bool) // Stacks are created only for push
+	addKey := func(key string, push bool) bool {
+		if key == "" {
+			return false
+		}
+		if _, ok := plans[key]; !ok {
+			plans[key] = &txPlan{}
+			keys = append(keys, key)
+		}
+		create[key] = create[key] || push
+		return true
+	}
+	for i, op := range tx.ops {
+		tx.ops[i].key = db.fullKey(op.key)
+		if !addKey(tx.ops[i].key, !op.pop) {
+			return nil, ErrInvalidKey
+		}
+		if op.to != "" {
+			tx.ops[i].to = db.fullKey(op.to)
+			if !addKey(tx.ops[i].to, true) {
+				return nil, ErrInvalidKey
+			}
+		}
+	}
+	defer db.lockKeys(keys...)()
+	// Stacks are not created until journal is saved, so failed transaction doesn't leave empty stacks
+	root := &Database{storage: db.storage}
+	for _, key := range keys {
+		s, err := root.Find(key, false)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			if !create[key] {
+				return nil, ErrNotFound
+			}
+			continue
+		}
+		s.LockCompaction()
+		defer s.UnlockCompaction()
+		plans[key].stack = s
+		plans[key].keep = s.Depth()
+	}
+	// Plan changes and collect results
+	results := make([]Segment, len(tx.ops))
+	popped := make([]int, len(tx.ops)) // Depth index of popped message
+	for i, op := range tx.ops {
+		plan := plans[op.key]
+		if !op.pop {
+			results[i].Depth = plan.push(op.header, op.data)
+			continue
+		}
+		segment, err := plan.pop()
+		if err != nil {
+			return nil, err
+		}
+		popped[i] = segment.Depth
+		if op.to != "" {
+			segment.Depth = plans[op.to].push(segment.Header, segment.Data)
+		}
+		results[i] = segment
+	}
+	// Save intent journal
+	var journal txJournal
+	for _, key := range keys {
+		plan := plans[key]
+		if plan.stack == nil {
+			if len(plan.data) > 0 {
+				journal.Stacks = append(journal.Stacks, txCheckpoint{Key: key, New: true})
+			}
+			continue
+		}
+		cp, err := plan.stack.Checkpoint(plan.keep)
+		if err != nil {
+			return nil, err
+		}
+		journal.Stacks = append(journal.Stacks, txCheckpoint{Key: key, Checkpoint: cp})
+	}
+	journalName, err := db.writeJournal(journal)
+	if err != nil {
+		return nil, err
+	}
+	// Create new stacks and apply changes
+	for _, key := range keys {
+		plan := plans[key]
+		if plan.stack == nil {
+			if len(plan.data) == 0 {
+				continue
+			}
+			if plan.stack, err = root.Find(key, true); err != nil {
+				break
+			}
+			plan.stack.LockCompaction()
+			defer plan.stack.UnlockCompaction()
+		}
+		if err = plan.apply(); err != nil {
+			break
+		}
+		if err = db.syncPushed(plan.stack); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Println("Transaction failed:", err, "- undo changes")
+		if undoErr := db.undo(journal); undoErr != nil {
+			// Journal is kept for next Scan
+			log.Println("Failed undo transaction:", undoErr)
+			return nil, err
+		}
+		if removeErr := db.removeJournal(journalName); removeErr != nil {
+			log.Println("Failed remove journal of undone transaction:", removeErr)
+		}
+		return nil, err
+	}
+	// Transaction is acknowledged only when journal can't be found by next Scan
+	if err = db.removeJournal(journalName); err != nil {
+		return nil, err
+	}
+	for i, op := range tx.ops {
+		if op.pop {
+			db.emit(EventPop, op.key, popped[i]-1)
+		}
+		if !op.pop {
+			db.emit(EventPush, op.key, results[i].Depth)
+		} else if op.to != "" {
+			db.emit(EventPush, op.to, results[i].Depth)
+		}
+	}
+	for _, key := range keys {
+		if len(plans[key].data) > 0 {
+			db.notify(key)
+		}
+	}
+	return results, nil
+}
+
+// Plan push of message. Returns depth index of message
+func (plan *txPlan) push(header, data []byte) int {
+	plan.headers = append(plan.headers, header)
+	plan.data = append(plan.data, data)
+	return plan.keep + len(plan.data)
+}
+
+// Plan pop of last message: message pushed by transaction or message of stack
+func (plan *txPlan) pop() (Segment, error) {
+	if n := len(plan.data); n > 0 {
+		segment := Segment{Depth: plan.keep + n, Header: plan.headers[n-1], Data: plan.data[n-1]}
+		plan.headers = plan.headers[:n-1]
+		plan.data = plan.data[:n-1]
+		return segment, nil
+	}
+	if plan.keep == 0 {
+		return Segment{}, ErrEmpty
+	}
+	header, data, err := plan.stack.At(plan.keep)
+	if err != nil {
+		return Segment{}, err
+	}
+	plan.keep--
+	return Segment{Depth: plan.keep + 1, Header: header, Data: data}, nil
+}
+
+// Apply planned changes to stack
+func (plan *txPlan) apply() error {
+	for plan.stack.Depth() > plan.keep {
+		if _, _, err := plan.stack.Pop(); err != nil && err != filestack.ErrCorrupted {
+			return err
+		}
+	}
+	_, err := plan.stack.PushMany(plan.headers, plan.data)
+	return err
+}
+
+// Write intent journal. Journal is synced only in SyncAlways mode: in other modes it undoes transaction
+// interrupted by process exit, but it may be lost by OS crash. Returns name of journal file
+func (st *storage) writeJournal(journal txJournal) (string, error) {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(st.rootDir, fmt.Sprint(txJournalPrefix, time.Now().UnixNano(), "-", atomic.AddUint64(&txSequence, 1)))
+	err = writeFile(name+filestack.TempSuffix, data, st.syncMode == SyncAlways)
+	if err != nil {
+		os.Remove(name + filestack.TempSuffix)
+		return "", err
+	}
+	err = os.Rename(name+filestack.TempSuffix, name)
+	if err != nil || st.syncMode != SyncAlways {
+		return name, err
+	}
+	return name, syncDir(st.rootDir)
+}
+
+// Remove intent journal and sync its removal by durability mode (by next group commit in SyncInterval mode).
+// Journal which reappears after crash undoes acknowledged transaction and all following pushes to its stacks
+func (st *storage) removeJournal(name string) error {
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	switch st.syncMode {
+	case SyncAlways:
+		return syncDir(st.rootDir)
+	case SyncInterval:
+		st.syncLock.Lock()
+		st.dirtyRoot = true
+		st.syncLock.Unlock()
+	}
+	return nil
+}
+
+// Restore affected stacks from intent journal and remove stacks created by transaction
+func (st *storage) undo(journal txJournal) error {
+	for _, stack := range journal.Stacks {
+		if stack.New {
+			if err := st.removeStack(stack.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		err := filestack.RestoreStack(st.fileName(stack.Key), stack.Checkpoint)
+		if err != nil {
+			return err
+		}
+		st.fileLock.RLock()
+		s, ok := st.files[stack.Key]
+		st.fileLock.RUnlock()
+		if ok {
+			if err = s.Repare(); err != nil {
+				return err
+			}
+			st.touch(stack.Key, s)
+		}
+	}
+	return nil
+}
+
+// Undo transactions interrupted by crash
+func (st *storage) recoverTx() error {
+	names, err := filepath.Glob(filepath.Join(st.rootDir, txJournalPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, filestack.TempSuffix) {
+			// Transaction was not started
+			os.Remove(name)
+			continue
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var journal txJournal
+		if err = json.Unmarshal(data, &journal); err != nil {
+			return err
+		}
+		if err = st.undo(journal); err != nil {
+			return err
+		}
+		log.Println("Interrupted transaction", filepath.Base(name), "undone")
+		if err = st.removeJournal(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock stack keys in sorted order to prevent deadlocks. Returns unlock function
+func (st *storage) lockKeys(keys ...string) func() {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	var locks []*keyLock
+	st.keyLocksLock.Lock()
+	for i, key := range sorted {
+		if i > 0 && sorted[i-1] == key {
+			continue
+		}
+		lock, ok := st.keyLocks[key]
+		if !ok {
+			lock = &keyLock{}
+			st.keyLocks[key] = lock
+		}
+		lock.refs++
+		locks = append(locks, lock)
+	}
+	st.keyLocksLock.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+		st.keyLocksLock.Lock()
+		for i, key := range sorted {
+			if i > 0 && sorted[i-1] == key {
+				continue
+			}
+			lock := st.keyLocks[key]
+			lock.refs--
+			if lock.refs == 0 {
+				delete(st.keyLocks, key)
+			}
+		}
+		st.keyLocksLock.Unlock()
+	}
+}
+
+// Write file and sync it if required
+func writeFile(name string, data []byte, sync bool) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Sync directory entries
+func syncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,47 @@
+package fstack
+
+import (
+	"log"
+	"sort"
+
+	"github.com/reddec/file-stack-db/filestack"
+)
+
+// BadBlock - damaged part of message in stack
+type BadBlock struct {
+	Key string // Stack key (relative for sub-section)
+	filestack.Corruption
+}
+
+// ScanVerify - scan stacks like Scan and check checksums of all messages. Returns every damaged block.
+// Stacks of old format (without checksums) are not verified
+func (db *Database) ScanVerify() ([]BadBlock, error) {
+	err := db.Scan()
+	if err != nil {
+		return nil, err
+	}
+	names := db.Names()
+	sort.Strings(names)
+	var bad []BadBlock
+	for _, name := range names {
+		s, err := db.Find(name, false)
+		if err != nil {
+			return bad, err
+		}
+		if s == nil {
+			continue
+		}
+		if s.Format() == filestack.FormatV1 {
+			log.Println("Stack", name, "has no checksums - skip verification")
+			continue
+		}
+		corruptions, err := s.Verify()
+		if err != nil {
+			return bad, err
+		}
+		for _, corruption := range corruptions {
+			bad = append(bad, BadBlock{Key: name, Corruption: corruption})
+		}
+	}
+	return bad, nil
+}
@@ -0,0 +1,46 @@
+package fstack
+
+import "time"
+
+// PopWait - get and remove last message from stack. If stack is empty or not exists, waits for
+// pushed message until timeout. Returns ErrEmpty or ErrNotFound after timeout
+func (db *Database) PopWait(key string, timeout time.Duration) (Segment, error) {
+	fullKey := db.fullKey(key)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		// Get notification channel before pop to not miss push between them
+		pushed := db.waiter(fullKey)
+		segment, err := db.Pop(key)
+		if err != ErrEmpty && err != ErrNotFound {
+			return segment, err
+		}
+		select {
+		case <-pushed:
+		case <-timer.C:
+			return segment, err
+		}
+	}
+}
+
+// Notification channel which will be closed after next push to stack
+func (st *storage) waiter(key string) <-chan struct{} {
+	st.waitLock.Lock()
+	defer st.waitLock.Unlock()
+	ch, ok := st.waiters[key]
+	if !ok {
+		ch = make(chan struct{})
+		st.waiters[key] = ch
+	}
+	return ch
+}
+
+// Wake up all waiters of stack
+func (st *storage) notify(key string) {
+	st.waitLock.Lock()
+	defer st.waitLock.Unlock()
+	if ch, ok := st.waiters[key]; ok {
+		close(ch)
+		delete(st.waiters, key)
+	}
+}
@@ -0,0 +1,82 @@
+package fstack
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of events buffer of watcher. Events are dropped if buffer is full
+const watchBufferSize = 128
+
+// EventType - kind of stack change
+type EventType string
+
+// Stack changes
+const (
+	EventPush EventType = "push"
+	EventPop  EventType = "pop"
+)
+
+// Event of stack change
+type Event struct {
+	Type  EventType // Kind of change
+	Key   string    // Stack name relative to watched database (or sub-section)
+	Depth int       // Depth of stack after operation
+	Time  time.Time // Time of operation
+}
+
+// Watcher of stack changes. Events of slow consumer are dropped
+type Watcher struct {
+	Events  <-chan Event // Events of stack changes. Closed after watcher close
+	events  chan Event
+	db      *Database
+	section string // Full name of watched section
+	once    sync.Once
+}
+
+// Watch - subscribe to changes (push and pop) of stacks in section (stack or sub-section) and all nested sections.
+// Empty section means whole database (or sub-section). Watcher must be closed after usage
+func (db *Database) Watch(section string) *Watcher {
+	events := make(chan Event, watchBufferSize)
+	w := &Watcher{Events: events, events: events, db: db, section: db.fullKey(section)}
+	db.watchLock.Lock()
+	defer db.watchLock.Unlock()
+	db.watchers[w] = true
+	return w
+}
+
+// Close watcher and events channel
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		w.db.watchLock.Lock()
+		defer w.db.watchLock.Unlock()
+		delete(w.db.watchers, w)
+		close(w.events)
+	})
+}
+
+// Check that stack with full key is inside watched section
+func (w *Watcher) match(key string) bool {
+	return w.section == "" || key == w.section || strings.HasPrefix(key, w.section+SectionSeparator)
+}
+
+// Send event about stack with full key to all matched watchers
+func (st *storage) emit(eventType EventType, key string, depth int) {
+	st.watchLock.RLock()
+	defer st.watchLock.RUnlock()
+	if len(st.watchers) == 0 {
+		return
+	}
+	now := time.Now()
+	for w := range st.watchers {
+		if !w.match(key) {
+			continue
+		}
+		name, _ := w.db.relativeKey(key)
+		select {
+		case w.events <- Event{Type: eventType, Key: name, Depth: depth, Time: now}:
+		default:
+		}
+	}
+}